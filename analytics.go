@@ -0,0 +1,332 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+type (
+	// Analytics keeps rolling, time bucketed request counts. Each ring only
+	// holds a fixed number of buckets, so memory stays bounded no matter how
+	// long the server runs.
+	Analytics struct {
+		rings []*ring
+	}
+
+	ring struct {
+		name    string
+		width   time.Duration
+		size    int
+		buckets []*bucket
+	}
+
+	bucket struct {
+		start     time.Time
+		requests  int
+		paths     map[string]int
+		statuses  map[string]int
+		referrers map[string]int
+		agents    map[string]int
+		latency   histogram
+	}
+
+	// histogram counts latencies in exponentially growing bins, the first
+	// one ending at latencyBase.
+	histogram [latencyBins]int
+
+	// AnalyticsReport is what /admin/traffic renders, and what
+	// /admin/traffic.json returns.
+	AnalyticsReport struct {
+		Windows []WindowReport `json:"windows"`
+	}
+
+	WindowReport struct {
+		Name    string         `json:"name"`
+		Total   BucketReport   `json:"total"`
+		Buckets []BucketReport `json:"buckets"`
+	}
+
+	BucketReport struct {
+		Start     time.Time      `json:"start"`
+		Requests  int            `json:"requests"`
+		Paths     map[string]int `json:"paths"`
+		Statuses  map[string]int `json:"statuses"`
+		Referrers map[string]int `json:"referrers"`
+		Agents    map[string]int `json:"user_agents"`
+		Latency   Percentiles    `json:"latency_ms"`
+	}
+
+	Percentiles struct {
+		P50 float64 `json:"p50"`
+		P90 float64 `json:"p90"`
+		P99 float64 `json:"p99"`
+	}
+
+	// statsPage is the data for the stats view.
+	statsPage struct {
+		ImgInfo
+		AnalyticsReport
+		Meta Meta
+	}
+
+	// Count is one row of a top-N list.
+	Count struct {
+		Key   string
+		Count int
+	}
+)
+
+const (
+	latencyBase = 10 * time.Microsecond
+	latencyBins = 24
+
+	// maxKeysPerBucket caps the distinct paths, referrers and so on in one
+	// bucket, so a scan of random URLs can't grow a bucket without limit.
+	maxKeysPerBucket = 200
+	otherKey         = "(other)"
+)
+
+func NewAnalytics() *Analytics {
+	return &Analytics{
+		rings: []*ring{
+			{name: "Last hour", width: time.Minute, size: 60},
+			{name: "Last day", width: time.Hour, size: 24},
+			{name: "Last month", width: 24 * time.Hour, size: 30},
+		},
+	}
+}
+
+// Record counts one finished request. The caller must hold the Stats
+// mutex.
+func (a *Analytics) Record(c echo.Context, timeIn time.Time, currentTime time.Time) {
+	path := c.Request().URL.Path
+	status := strconv.Itoa(c.Response().Status)
+	referrer := referrerHost(c.Request())
+	agent := agentClass(c.Request().UserAgent())
+	latency := currentTime.Sub(timeIn)
+
+	for _, r := range a.rings {
+		b := r.bucketFor(timeIn)
+		b.requests++
+		incr(b.paths, path)
+		incr(b.statuses, status)
+		incr(b.referrers, referrer)
+		incr(b.agents, agent)
+		b.latency.add(latency)
+	}
+}
+
+// Report summarizes every ring as of now. The caller must hold at least a
+// read lock on the Stats mutex.
+func (a *Analytics) Report(now time.Time) AnalyticsReport {
+	report := AnalyticsReport{}
+	for _, r := range a.rings {
+		window := WindowReport{Name: r.name}
+		total := newBucket(time.Time{})
+		oldest := now.Truncate(r.width).Add(-time.Duration(r.size-1) * r.width)
+
+		for _, b := range r.buckets {
+			if b.start.Before(oldest) {
+				continue
+			}
+			window.Buckets = append(window.Buckets, b.report())
+			total.merge(b)
+		}
+
+		total.start = oldest
+		window.Total = total.report()
+		report.Windows = append(report.Windows, window)
+	}
+	return report
+}
+
+func (r *ring) bucketFor(t time.Time) *bucket {
+	start := t.Truncate(r.width)
+	if n := len(r.buckets); n > 0 && !r.buckets[n-1].start.Before(start) {
+		return r.buckets[n-1]
+	}
+
+	b := newBucket(start)
+	r.buckets = append(r.buckets, b)
+	if len(r.buckets) > r.size {
+		r.buckets = r.buckets[len(r.buckets)-r.size:]
+	}
+	return b
+}
+
+func newBucket(start time.Time) *bucket {
+	return &bucket{
+		start:     start,
+		paths:     map[string]int{},
+		statuses:  map[string]int{},
+		referrers: map[string]int{},
+		agents:    map[string]int{},
+	}
+}
+
+func (b *bucket) merge(other *bucket) {
+	b.requests += other.requests
+	mergeCounts(b.paths, other.paths)
+	mergeCounts(b.statuses, other.statuses)
+	mergeCounts(b.referrers, other.referrers)
+	mergeCounts(b.agents, other.agents)
+	for i, n := range other.latency {
+		b.latency[i] += n
+	}
+}
+
+func (b *bucket) report() BucketReport {
+	return BucketReport{
+		Start:     b.start,
+		Requests:  b.requests,
+		Paths:     copyCounts(b.paths),
+		Statuses:  copyCounts(b.statuses),
+		Referrers: copyCounts(b.referrers),
+		Agents:    copyCounts(b.agents),
+		Latency: Percentiles{
+			P50: b.latency.percentile(0.50),
+			P90: b.latency.percentile(0.90),
+			P99: b.latency.percentile(0.99),
+		},
+	}
+}
+
+func (h *histogram) add(d time.Duration) {
+	i := 0
+	for limit := latencyBase; d > limit && i < latencyBins-1; limit *= 2 {
+		i++
+	}
+	h[i]++
+}
+
+// percentile returns the upper edge, in milliseconds, of the bin holding
+// the p'th latency.
+func (h *histogram) percentile(p float64) float64 {
+	total := 0
+	for _, n := range h {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+
+	seen := 0
+	limit := latencyBase
+	for i, n := range h {
+		seen += n
+		if float64(seen) >= p*float64(total) || i == latencyBins-1 {
+			break
+		}
+		limit *= 2
+	}
+	return float64(limit) / float64(time.Millisecond)
+}
+
+func incr(m map[string]int, key string) {
+	if _, ok := m[key]; !ok && len(m) >= maxKeysPerBucket {
+		key = otherKey
+	}
+	m[key]++
+}
+
+func mergeCounts(dst, src map[string]int) {
+	for k, v := range src {
+		dst[k] += v
+	}
+}
+
+func copyCounts(m map[string]int) map[string]int {
+	out := make(map[string]int, len(m))
+	for k, v := range m {
+		out[k] = v
+	}
+	return out
+}
+
+// top returns the n largest counts in m, largest first.
+func top(m map[string]int, n int) []Count {
+	counts := make([]Count, 0, len(m))
+	for k, v := range m {
+		counts = append(counts, Count{Key: k, Count: v})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Key < counts[j].Key
+	})
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
+
+// referrerHost keeps only the host of the Referer header, which is enough
+// to tell where traffic comes from without recording full URLs.
+func referrerHost(r *http.Request) string {
+	ref := r.Referer()
+	if ref == "" {
+		return "(direct)"
+	}
+	u, err := url.Parse(ref)
+	if err != nil || u.Host == "" {
+		return "(invalid)"
+	}
+	if u.Host == r.Host {
+		return "(internal)"
+	}
+	return u.Host
+}
+
+func agentClass(ua string) string {
+	ua = strings.ToLower(ua)
+	switch {
+	case ua == "":
+		return "unknown"
+	case strings.Contains(ua, "bot"),
+		strings.Contains(ua, "crawl"),
+		strings.Contains(ua, "spider"),
+		strings.Contains(ua, "slurp"):
+		return "bot"
+	case strings.Contains(ua, "curl"),
+		strings.Contains(ua, "wget"),
+		strings.Contains(ua, "python"),
+		strings.Contains(ua, "go-http-client"):
+		return "tool"
+	case strings.Contains(ua, "mobile"),
+		strings.Contains(ua, "android"),
+		strings.Contains(ua, "iphone"):
+		return "mobile"
+	case strings.Contains(ua, "mozilla"):
+		return "desktop"
+	default:
+		return "other"
+	}
+}
+
+func (s *Stats) serveDashboard(c echo.Context) error {
+	s.mutex.RLock()
+	report := s.analytics.Report(time.Now().UTC())
+	s.mutex.RUnlock()
+
+	site := currentSite()
+	return site.writeView(c, http.StatusOK, "stats", statsPage{
+		ImgInfo:         site.photo(c),
+		AnalyticsReport: report,
+		Meta:            site.meta(c, "Traffic", "How many people visit this site, and where from."),
+	})
+}
+
+func (s *Stats) serveDashboardJSON(c echo.Context) error {
+	s.mutex.RLock()
+	report := s.analytics.Report(time.Now().UTC())
+	s.mutex.RUnlock()
+
+	return c.JSONPretty(http.StatusOK, report, "\t")
+}
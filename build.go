@@ -0,0 +1,410 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+// buildManifest records what the last build was made from and the files
+// it wrote, so the next one can tell what changed since, and remove the
+// files it no longer makes without touching anything else in the
+// directory.
+const buildManifest = ".build-manifest"
+
+// manifest is what a build records in buildManifest.
+type manifest struct {
+	config uint64
+	// watched is the fingerprint of every watched directory together, and
+	// sources that of each file in them.
+	watched uint64
+	sources map[string]uint64
+	files   []string
+}
+
+// builder renders a loaded site to files.
+type builder struct {
+	s *site
+	e *echo.Echo
+	// files maps every route to the file it is written to, as a slash
+	// separated path from the root of the build.
+	files map[string]string
+	out   map[string][]byte
+}
+
+var (
+	linkAttr   = regexp.MustCompile(`(href|src)="(/[^"]*)"`)
+	srcsetAttr = regexp.MustCompile(`srcset="([^"]*)"`)
+)
+
+// build writes a static copy of s to cfg.BuildDir: every page rendered
+// through the same handlers the server uses, and every cached asset. Links
+// between them are made relative, so the copy works from any directory or
+// straight off the disk, except for 404.html. Only the pages a change to
+// the sources can show on are rendered again; the rest are kept from the
+// last build. Files that come out the same as last time are left alone, so
+// syncing the directory only sends what changed.
+func build(s *site, cfg Config, logf func(format string, args ...interface{})) error {
+	s.rotator = pageRotation{}
+	current.Store(s)
+
+	e := echo.New()
+	e.HTTPErrorHandler = httpErrorHandler(logf)
+	setSiteRoutes(e, cfg)
+
+	b := &builder{
+		s:     s,
+		e:     e,
+		files: map[string]string{},
+		out:   map[string][]byte{},
+	}
+	next := newManifest(cfg)
+	last, ok := readManifest(cfg.BuildDir)
+	stale := staleRoutes(cfg, last, ok, next)
+
+	var pages []string
+	for _, page := range s.pageRoutes(cfg.PostsPerPage) {
+		pages = append(pages, page.route)
+		b.files[page.route] = pageFile(page.route)
+	}
+	for route := range s.blobs {
+		b.files[route] = route
+	}
+	if len(s.icons) > 0 {
+		b.files["/favicon.ico"] = "/favicon.ico"
+	}
+	b.files["/"] = "/index.html"
+	for from := range cfg.Redirects {
+		if _, ok := b.files[from]; !ok {
+			b.files[from] = pageFile(from)
+		}
+	}
+
+	rendered := 0
+	for _, route := range pages {
+		file := b.files[route]
+		if stale != nil && !stale(route) {
+			data, err := ioutil.ReadFile(filepath.Join(cfg.BuildDir, filepath.FromSlash(file)))
+			if err == nil {
+				b.out[file] = data
+				continue
+			}
+		}
+		status, body := b.get(route)
+		if status != http.StatusOK {
+			return fmt.Errorf("rendering %v: got status %v", route, status)
+		}
+		b.out[file] = b.rewrite(file, body)
+		rendered++
+	}
+	// Static hosts serve 404.html at whatever path was missing, so its
+	// links have to stay absolute, and only work when the site is at the
+	// root of its domain.
+	_, body := b.get("/404")
+	b.out["/404.html"] = body
+
+	for route, blob := range s.blobs {
+		b.out[route] = blob.data
+	}
+	if len(s.icons) > 0 {
+		b.out["/favicon.ico"] = s.icons[0].data
+	}
+
+	b.redirect("/", cfg.Home)
+	for from, to := range cfg.Redirects {
+		if _, ok := b.out[b.files[from]]; !ok {
+			b.redirect(from, to)
+		}
+	}
+
+	written, unchanged, removed, err := b.write(cfg.BuildDir, last.files, next)
+	if err != nil {
+		return err
+	}
+	logf("built %v files in %v, rendering %v of %v pages: %v written, %v unchanged, %v removed", len(b.out), cfg.BuildDir, rendered, len(pages), written, unchanged, removed)
+	return nil
+}
+
+// newManifest fingerprints the config and sources a build is about to be
+// made from.
+func newManifest(cfg Config) manifest {
+	dirs := cfg.watchDirs()
+	return manifest{
+		config:  configFingerprint(cfg),
+		watched: fingerprint(dirs),
+		sources: fileFingerprints(dirs),
+	}
+}
+
+// configFingerprint hashes the settings a build goes by. The admin
+// credentials and TLS settings are left out: they don't show in the
+// output, and the manifest is published along with it.
+func configFingerprint(cfg Config) uint64 {
+	cfg.Admin = AdminConfig{}
+	cfg.TLS = TLSConfig{}
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%+v", cfg)
+	return h.Sum64()
+}
+
+// readManifest reads the manifest of the last build in dir, if there was
+// one.
+func readManifest(dir string) (manifest, bool) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, buildManifest))
+	if err != nil {
+		return manifest{}, false
+	}
+	m := manifest{sources: map[string]uint64{}}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.SplitN(line, " ", 3)
+		switch {
+		case strings.HasPrefix(line, "/"):
+			m.files = append(m.files, line)
+		case fields[0] == "config" && len(fields) == 2:
+			m.config, _ = strconv.ParseUint(fields[1], 16, 64)
+		case fields[0] == "watched" && len(fields) == 2:
+			m.watched, _ = strconv.ParseUint(fields[1], 16, 64)
+		case fields[0] == "source" && len(fields) == 3:
+			m.sources[fields[2]], _ = strconv.ParseUint(fields[1], 16, 64)
+		}
+	}
+	return m, true
+}
+
+// bytes formats m for buildManifest: the fingerprints first, then one
+// file per line.
+func (m manifest) bytes() []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "config %x\nwatched %x\n", m.config, m.watched)
+	sources := make([]string, 0, len(m.sources))
+	for file := range m.sources {
+		sources = append(sources, file)
+	}
+	sort.Strings(sources)
+	for _, file := range sources {
+		fmt.Fprintf(&buf, "source %x %v\n", m.sources[file], file)
+	}
+	for _, file := range m.files {
+		fmt.Fprintf(&buf, "%v\n", file)
+	}
+	return buf.Bytes()
+}
+
+// upToDate reports whether the last build in cfg.BuildDir was made from
+// the same config and sources as a build now would be, and its files are
+// all still there, so there is nothing to do.
+func upToDate(cfg Config) bool {
+	last, ok := readManifest(cfg.BuildDir)
+	if !ok || last.config != configFingerprint(cfg) || last.watched != fingerprint(cfg.watchDirs()) {
+		return false
+	}
+	for _, file := range last.files {
+		if _, err := os.Stat(filepath.Join(cfg.BuildDir, filepath.FromSlash(file))); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// staleRoutes works out which pages have to be rendered again, going by
+// the sources that changed since the last build. It returns nil when all
+// of them do: on a first build, after the config changed, or when the
+// change shows on every page, like one to the template, the assets, the
+// photos, or the home or links page the person is taken from. Otherwise a
+// content file only shows on its own page, and a post on its own page and
+// the lists of posts.
+func staleRoutes(cfg Config, last manifest, ok bool, next manifest) func(route string) bool {
+	if !ok || last.config != next.config {
+		return nil
+	}
+	var changed []string
+	for file, sum := range next.sources {
+		if old, ok := last.sources[file]; !ok || old != sum {
+			changed = append(changed, file)
+		}
+	}
+	for file := range last.sources {
+		if _, ok := next.sources[file]; !ok {
+			changed = append(changed, file)
+		}
+	}
+
+	pages := map[string]bool{}
+	posts := false
+	for _, file := range changed {
+		dir, name := filepath.Dir(file), filepath.Base(file)
+		if filepath.Ext(name) != ".md" {
+			return nil
+		}
+		name = strings.TrimSuffix(name, ".md")
+		switch dir {
+		case filepath.Clean(cfg.ContentDir):
+			route := "/" + name
+			if route == cfg.Home || route == linksPage {
+				return nil
+			}
+			pages[route] = true
+		case filepath.Clean(cfg.PostsDir):
+			pages["/posts/"+name] = true
+			posts = true
+		default:
+			return nil
+		}
+	}
+
+	return func(route string) bool {
+		if pages[route] {
+			return true
+		}
+		return posts && (route == "/posts" || strings.HasPrefix(route, "/posts?") ||
+			strings.HasPrefix(route, "/tags/") || strings.HasPrefix(route, "/archive/"))
+	}
+}
+
+// pageFile is the file a page is written to. Later pages of the posts
+// index get directories of their own, since files can't have queries.
+func pageFile(route string) string {
+	if strings.HasPrefix(route, "/posts?page=") {
+		return "/posts/page/" + strings.TrimPrefix(route, "/posts?page=") + "/index.html"
+	}
+	return strings.TrimSuffix(route, "/") + "/index.html"
+}
+
+// get renders route the way the server would answer it.
+func (b *builder) get(route string) (int, []byte) {
+	rec := httptest.NewRecorder()
+	b.e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, route, nil))
+	return rec.Code, rec.Body.Bytes()
+}
+
+// rewrite points the internal links of the page written to file at the
+// files they were written to.
+func (b *builder) rewrite(file string, page []byte) []byte {
+	page = linkAttr.ReplaceAllFunc(page, func(m []byte) []byte {
+		parts := linkAttr.FindSubmatch(m)
+		return []byte(fmt.Sprintf(`%s="%v"`, parts[1], b.link(file, string(parts[2]))))
+	})
+	return srcsetAttr.ReplaceAllFunc(page, func(m []byte) []byte {
+		candidates := strings.Split(string(srcsetAttr.FindSubmatch(m)[1]), ", ")
+		for i, candidate := range candidates {
+			fields := strings.Fields(candidate)
+			if len(fields) > 0 && strings.HasPrefix(fields[0], "/") {
+				fields[0] = b.link(file, fields[0])
+			}
+			candidates[i] = strings.Join(fields, " ")
+		}
+		return []byte(fmt.Sprintf(`srcset="%v"`, strings.Join(candidates, ", ")))
+	})
+}
+
+// link makes target, a link on the page written to file, relative to it.
+// Links to routes that weren't built are left as they are.
+func (b *builder) link(file, target string) string {
+	u, err := url.Parse(html.UnescapeString(target))
+	if err != nil {
+		return target
+	}
+
+	route := u.Path
+	if page := u.Query().Get("page"); route == "/posts" && page != "" && page != "1" {
+		route += "?page=" + page
+	}
+	// Fingerprinted names keep the extension, which static hosts go by.
+	to, ok := b.s.fingerprints[route]
+	if !ok {
+		to, ok = b.files[route]
+	}
+	if !ok {
+		return target
+	}
+
+	rel, err := filepath.Rel(filepath.FromSlash(path.Dir(file)), filepath.FromSlash(to))
+	if err != nil {
+		return target
+	}
+	link := escapeURL(filepath.ToSlash(rel))
+	if u.Fragment != "" {
+		link += "#" + u.Fragment
+	}
+	return html.EscapeString(link)
+}
+
+// redirect writes a page at from that sends browsers on to to, since a
+// static host can't be told to redirect.
+func (b *builder) redirect(from, to string) {
+	file := b.files[from]
+	target := to
+	if strings.HasPrefix(to, "/") {
+		target = b.link(file, to)
+	}
+	b.out[file] = []byte(fmt.Sprintf(`<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="utf-8">
+    <meta http-equiv="refresh" content="0; url=%[1]v">
+</head>
+<body>
+    <a href="%[1]v">This page has moved.</a>
+</body>
+</html>
+`, target))
+}
+
+// write puts every built file in dir, skipping the ones that are already
+// there as built, removes the files the last build made that this one
+// didn't, and records m and the files in the manifest.
+func (b *builder) write(dir string, last []string, m manifest) (written, unchanged, removed int, err error) {
+	files := make([]string, 0, len(b.out))
+	for file, data := range b.out {
+		files = append(files, file)
+
+		target := filepath.Join(dir, filepath.FromSlash(file))
+		if old, err := ioutil.ReadFile(target); err == nil && bytes.Equal(old, data) {
+			unchanged++
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return written, unchanged, removed, err
+		}
+		if err := ioutil.WriteFile(target, data, 0644); err != nil {
+			return written, unchanged, removed, err
+		}
+		written++
+	}
+
+	for _, file := range last {
+		if _, ok := b.out[file]; ok {
+			continue
+		}
+		err := os.Remove(filepath.Join(dir, filepath.FromSlash(file)))
+		if err != nil && !os.IsNotExist(err) {
+			return written, unchanged, removed, err
+		}
+		removed++
+		// Take the page's directories with it once they are empty.
+		for parent := path.Dir(file); parent != "/"; parent = path.Dir(parent) {
+			if os.Remove(filepath.Join(dir, filepath.FromSlash(parent))) != nil {
+				break
+			}
+		}
+	}
+
+	sort.Strings(files)
+	m.files = files
+	err = ioutil.WriteFile(filepath.Join(dir, buildManifest), m.bytes(), 0644)
+	return written, unchanged, removed, err
+}
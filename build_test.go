@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestManifestRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "build")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	m := manifest{
+		config:  1,
+		watched: 0xfedcba9876543210,
+		sources: map[string]uint64{"content/about.md": 2, "assets/my photo.jpg": 3},
+		files:   []string{"/about/index.html", "/photos/my photo/index.html"},
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, buildManifest), m.bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, ok := readManifest(dir)
+	if !ok || !reflect.DeepEqual(got, m) {
+		t.Errorf("read back %+v, want %+v", got, m)
+	}
+}
+
+func TestStaleRoutes(t *testing.T) {
+	cfg := defaultConfig()
+	last := manifest{config: 1, sources: map[string]uint64{
+		"content/about.md":   1,
+		"content/links.md":   1,
+		"content/history.md": 1,
+		"posts/first.md":     1,
+		"assets/style.css":   1,
+	}}
+	changed := func(files ...string) manifest {
+		next := manifest{config: 1, sources: map[string]uint64{}}
+		for file, sum := range last.sources {
+			next.sources[file] = sum
+		}
+		for _, file := range files {
+			next.sources[file]++
+		}
+		return next
+	}
+	routes := []string{"/about", "/history", "/posts", "/posts?page=2", "/posts/first", "/posts/second", "/tags/go", "/archive/2020", "/photos", "/photos/lake"}
+
+	for _, test := range []struct {
+		name  string
+		next  manifest
+		stale []string
+	}{
+		{"nothing", changed(), nil},
+		{"a page", changed("content/history.md"), []string{"/history"}},
+		{"a post", changed("posts/first.md"), []string{"/posts", "/posts?page=2", "/posts/first", "/tags/go", "/archive/2020"}},
+		{"a new post", changed("posts/second.md"), []string{"/posts", "/posts?page=2", "/posts/second", "/tags/go", "/archive/2020"}},
+	} {
+		stale := staleRoutes(cfg, last, true, test.next)
+		if stale == nil {
+			t.Errorf("%v: renders everything", test.name)
+			continue
+		}
+		var got []string
+		for _, route := range routes {
+			if stale(route) {
+				got = append(got, route)
+			}
+		}
+		if !reflect.DeepEqual(got, test.stale) {
+			t.Errorf("%v: renders %v, want %v", test.name, got, test.stale)
+		}
+	}
+
+	removed := changed()
+	delete(removed.sources, "posts/first.md")
+	if stale := staleRoutes(cfg, last, true, removed); stale == nil || !stale("/posts") {
+		t.Error("removing a post doesn't render the posts again")
+	}
+
+	for _, test := range []struct {
+		name string
+		next manifest
+	}{
+		{"the home page", changed("content/about.md")},
+		{"the links page", changed("content/links.md")},
+		{"an asset", changed("assets/style.css")},
+		{"the config", manifest{config: 2, sources: last.sources}},
+	} {
+		if staleRoutes(cfg, last, true, test.next) != nil {
+			t.Errorf("%v: doesn't render everything", test.name)
+		}
+	}
+	if staleRoutes(cfg, manifest{}, false, last) != nil {
+		t.Error("first build: doesn't render everything")
+	}
+}
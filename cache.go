@@ -0,0 +1,126 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Asset classes, each with its own Cache-Control in the config.
+const (
+	classFile          = "file"
+	classImage         = "image"
+	classIcon          = "icon"
+	classFingerprinted = "fingerprinted"
+)
+
+var assetClasses = []string{classFile, classImage, classIcon, classFingerprinted}
+
+// newBlob computes the validators and compressed variants of data once,
+// when it is loaded, so answering a request costs a map lookup and a string
+// compare.
+func newBlob(data []byte, contentType string, modTime time.Time, cacheControl string) blob {
+	sum := sha256.Sum256(data)
+	return blob{
+		data:         data,
+		contentType:  contentType,
+		hash:         hex.EncodeToString(sum[:])[:16],
+		modTime:      modTime.UTC().Truncate(time.Second),
+		cacheControl: cacheControl,
+		variants:     precompress(data, contentType),
+	}
+}
+
+// etag differs per encoding, since each one is a different byte sequence.
+func (b blob) etag(encoding string) string {
+	if encoding == "" {
+		return `"` + b.hash + `"`
+	}
+	return `"` + b.hash + "-" + encoding + `"`
+}
+
+// writeBlob sends b in the best encoding the client accepts, or 304 Not
+// Modified when the client's copy is still current, or just the byte ranges
+// asked for.
+func writeBlob(c echo.Context, b blob) error {
+	h := c.Response().Header()
+
+	data, encoding := b.data, ""
+	if len(b.variants) > 0 {
+		h.Add("Vary", "Accept-Encoding")
+		if encoding = b.encodingFor(c.Request()); encoding != "" {
+			data = b.variants[encoding]
+			h.Set("Content-Encoding", encoding)
+		}
+	}
+
+	etag := b.etag(encoding)
+	h.Set("ETag", etag)
+	h.Set("Last-Modified", b.modTime.Format(http.TimeFormat))
+	if b.cacheControl != "" {
+		h.Set("Cache-Control", b.cacheControl)
+	}
+
+	if notModified(c.Request(), etag, b.modTime) {
+		h.Del("Content-Encoding")
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	// Ranges are of whichever encoding was picked, which is why each one
+	// has its own etag.
+	h.Set("Accept-Ranges", "bytes")
+	if handled, err := writeRanges(c, data, b.contentType, etag, b.modTime); handled {
+		return err
+	}
+
+	h.Set("Content-Length", strconv.Itoa(len(data)))
+	return c.Blob(http.StatusOK, b.contentType, data)
+}
+
+// notModified follows RFC 7232: If-None-Match wins when both validators
+// are sent.
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagMatches(inm, etag)
+	}
+
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		t, err := http.ParseTime(ims)
+		return err == nil && !modTime.After(t)
+	}
+
+	return false
+}
+
+// etagMatches does the weak comparison If-None-Match calls for against a
+// comma separated list of tags.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// fingerprintedRoute puts the content hash in front of the file's
+// extension ext, so /style for style.css becomes /style.<hash>.css. The URL
+// changes whenever the content does, which makes it safe to cache forever.
+func fingerprintedRoute(route, ext, hash string) string {
+	return strings.TrimSuffix(route, ext) + "." + hash + ext
+}
+
+// assetURL is the "asset" template function: the fingerprinted URL of the
+// file served at route, or route itself if there is no such file.
+func (s *site) assetURL(route string) string {
+	if url, ok := s.fingerprints[route]; ok {
+		return url
+	}
+	return route
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/labstack/echo"
+)
+
+// encodings are the content codings we can send, most preferred first.
+var encodings = []string{"br", "gzip"}
+
+// compressible reports whether contentType is worth compressing. Formats
+// like JPEG, PNG and PDF are already compressed and would only grow.
+func compressible(contentType string) bool {
+	ct := strings.ToLower(contentType)
+	return strings.HasPrefix(ct, "text/") ||
+		strings.Contains(ct, "svg") ||
+		strings.Contains(ct, "json") ||
+		strings.Contains(ct, "javascript") ||
+		strings.Contains(ct, "xml")
+}
+
+func compress(encoding string, data []byte, best bool) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+
+	switch encoding {
+	case "br":
+		level := brotli.DefaultCompression
+		if best {
+			level = brotli.BestCompression
+		}
+		w = brotli.NewWriterLevel(&buf, level)
+	case "gzip":
+		level := gzip.BestSpeed
+		if best {
+			level = gzip.BestCompression
+		}
+		var err error
+		if w, err = gzip.NewWriterLevel(&buf, level); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// precompress returns every encoding of data that comes out smaller than
+// data itself, compressed as hard as possible since it only happens once
+// per load.
+func precompress(data []byte, contentType string) map[string][]byte {
+	if !compressible(contentType) {
+		return nil
+	}
+
+	variants := map[string][]byte{}
+	for _, encoding := range encodings {
+		compressed, err := compress(encoding, data, true)
+		if err == nil && len(compressed) < len(data) {
+			variants[encoding] = compressed
+		}
+	}
+	return variants
+}
+
+// negotiateEncoding picks the encoding to answer an Accept-Encoding header
+// with, or "" for the identity encoding. The highest q value wins, and ties
+// go to the order of encodings.
+func negotiateEncoding(acceptEncoding string, available func(encoding string) bool) string {
+	q := map[string]float64{}
+	wildcard := -1.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		weight := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if w, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					weight = w
+				}
+			}
+		}
+		if name == "*" {
+			wildcard = weight
+		} else if name != "" {
+			q[name] = weight
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range encodings {
+		weight, ok := q[encoding]
+		if !ok {
+			weight = wildcard
+		}
+		if weight > bestQ && available(encoding) {
+			best, bestQ = encoding, weight
+		}
+	}
+	return best
+}
+
+// writeHTML sends a rendered page, compressed on the fly since pages change
+// on every request.
+func writeHTML(c echo.Context, status int, html []byte) error {
+	h := c.Response().Header()
+	h.Add("Vary", "Accept-Encoding")
+
+	encoding := negotiateEncoding(c.Request().Header.Get("Accept-Encoding"), func(string) bool { return true })
+	if encoding != "" {
+		compressed, err := compress(encoding, html, false)
+		if err != nil {
+			return err
+		}
+		h.Set("Content-Encoding", encoding)
+		html = compressed
+	}
+
+	return c.Blob(status, echo.MIMETextHTMLCharsetUTF8, html)
+}
+
+// encodingFor negotiates which variant of b to send.
+func (b blob) encodingFor(r *http.Request) string {
+	return negotiateEncoding(r.Header.Get("Accept-Encoding"), func(encoding string) bool {
+		_, ok := b.variants[encoding]
+		return ok
+	})
+}
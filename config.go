@@ -0,0 +1,484 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+	"gopkg.in/yaml.v2"
+)
+
+type (
+	// Config is everything that differs between deployments. It is read
+	// from a YAML file, then overridden by environment variables, then by
+	// command line flags.
+	Config struct {
+		Addr string `yaml:"addr"`
+		// TrustedProxies are the addresses, or CIDR ranges, of the proxies
+		// in front of the server. Only they can set the visitor's address
+		// with X-Forwarded-For or X-Real-IP.
+		TrustedProxies []string `yaml:"trusted_proxies"`
+		// BaseURL is where the site is reachable, like https://example.com.
+		// Feeds need it to link back to the site.
+		BaseURL string `yaml:"base_url"`
+		// Author is who the site is about, named in feeds.
+		Author string `yaml:"author"`
+		// TagAuthority names the site in feed IDs: a domain or email
+		// address the author owns and a date they owned it on, like
+		// example.com,2020 (see RFC 4151). IDs must never change, so it
+		// stays the same when the site moves to another base_url.
+		TagAuthority string `yaml:"tag_authority"`
+		Template     string `yaml:"template"`
+		ContentDir   string `yaml:"content_dir"`
+		PostsDir     string `yaml:"posts_dir"`
+		// PostsPerPage is how many posts each page of /posts lists.
+		PostsPerPage int `yaml:"posts_per_page"`
+		// BuildDir is where build writes the static copy of the site.
+		BuildDir string `yaml:"build_dir"`
+		ImageDir string `yaml:"image_dir"`
+		// Home is the page / redirects to.
+		Home string `yaml:"home"`
+		// Redirects maps old routes to where they moved. They are sent as
+		// 301s, so browsers remember them.
+		Redirects map[string]string `yaml:"redirects"`
+		// ImageRoute is the URL prefix the files in ImageDir are served
+		// under.
+		ImageRoute string `yaml:"image_route"`
+		// Files maps a route to the file served at it.
+		Files    map[string]string `yaml:"files"`
+		Favicons []string          `yaml:"favicons"`
+		// CacheControl is sent with each class of asset: file, image, icon,
+		// and fingerprinted for URLs that change with their content.
+		CacheControl map[string]string `yaml:"cache_control"`
+		// MIMETypes overrides the content type of files by extension, e.g.
+		// ".css": "text/css; charset=utf-8".
+		MIMETypes map[string]string `yaml:"mime_types"`
+		Images    ImagesConfig      `yaml:"images"`
+		Robots    RobotsConfig      `yaml:"robots"`
+		// AllowDegraded starts the server even when some files are missing
+		// or broken, as long as pages can still be rendered.
+		AllowDegraded bool `yaml:"allow_degraded"`
+
+		ReloadInterval  time.Duration `yaml:"reload_interval"`
+		ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+		Stats StatsConfig `yaml:"stats"`
+		Admin AdminConfig `yaml:"admin"`
+		// TLS replaces Addr with an HTTP and an HTTPS listener when ACME
+		// is on.
+		TLS TLSConfig `yaml:"tls"`
+	}
+
+	StatsConfig struct {
+		File          string        `yaml:"file"`
+		FlushInterval time.Duration `yaml:"flush_interval"`
+		IPMode        IPMode        `yaml:"ip_mode"`
+		MaxIPs        int           `yaml:"max_ips"`
+	}
+
+	// AdminConfig holds the credentials for /admin. Leave them out of the
+	// config file and set ADMIN_USER and ADMIN_PASSWORD instead where you
+	// can.
+	AdminConfig struct {
+		User     string `yaml:"user"`
+		Password string `yaml:"password"`
+	}
+
+	// override is a setting that can be changed from the environment and
+	// the command line. The flag is the environment variable in lower case
+	// with dashes, so ADMIN_USER is -admin-user.
+	override struct {
+		env   string
+		usage string
+		set   func(c *Config, v string) error
+	}
+)
+
+func defaultConfig() Config {
+	return Config{
+		Addr:           ":8000",
+		TrustedProxies: []string{"127.0.0.1", "::1"},
+		Template:       "assets/template.html",
+		ContentDir:     "content",
+		ImageDir:       "assets/img",
+		Home:           "/about",
+		BaseURL:        "http://localhost:8000",
+		Author:         "Nathan Mannes",
+		TagAuthority:   "localhost,2020",
+		PostsDir:       "posts",
+		PostsPerPage:   10,
+		BuildDir:       "public",
+		ImageRoute:     "/assets/img",
+		Files: map[string]string{
+			"/style":  "assets/style.css",
+			"/resume": "assets/mannes_resume.pdf",
+		},
+		Favicons: []string{"assets/m.png", "assets/n.png"},
+		CacheControl: map[string]string{
+			classFile:          "public, max-age=3600",
+			classImage:         "public, max-age=86400",
+			classIcon:          "no-cache",
+			classFingerprinted: "public, max-age=31536000, immutable",
+		},
+		Images: ImagesConfig{
+			Widths:   []int{320, 640, 1024},
+			Quality:  82,
+			Sizes:    "(max-width: 540px) 100vw, 500px",
+			CacheDir: ".image-cache",
+			Rotation: RotationShuffle,
+		},
+		Robots: RobotsConfig{
+			Disallow: []string{"/admin/", "/healthz"},
+		},
+		ReloadInterval:  2 * time.Second,
+		ShutdownTimeout: 10 * time.Second,
+		Stats: StatsConfig{
+			File:          "stats.json",
+			FlushInterval: time.Minute,
+			IPMode:        IPTruncated,
+			MaxIPs:        1000,
+		},
+		TLS: TLSConfig{
+			CacheDir:     "certs",
+			DirectoryURL: autocert.DefaultACMEDirectory,
+			HTTPAddr:     ":80",
+			HTTPSAddr:    ":443",
+			HSTSMaxAge:   63072000,
+		},
+	}
+}
+
+var overrides = []override{
+	{"ADDR", "address to listen on", func(c *Config, v string) error {
+		c.Addr = v
+		return nil
+	}},
+	{"TRUSTED_PROXIES", "comma separated addresses of proxies allowed to forward the visitor's address", func(c *Config, v string) error {
+		c.TrustedProxies = strings.Split(v, ",")
+		return nil
+	}},
+	{"BASE_URL", "URL the site is reachable at, for links in feeds", func(c *Config, v string) error {
+		c.BaseURL = v
+		return nil
+	}},
+	{"TAG_AUTHORITY", "domain and date feed IDs are built from, like example.com,2020", func(c *Config, v string) error {
+		c.TagAuthority = v
+		return nil
+	}},
+	{"TEMPLATE", "page layout template", func(c *Config, v string) error {
+		c.Template = v
+		return nil
+	}},
+	{"CONTENT_DIR", "directory of markdown pages", func(c *Config, v string) error {
+		c.ContentDir = v
+		return nil
+	}},
+	{"POSTS_DIR", "directory of posts", func(c *Config, v string) error {
+		c.PostsDir = v
+		return nil
+	}},
+	{"BUILD_DIR", "directory build writes the static site to", func(c *Config, v string) error {
+		c.BuildDir = v
+		return nil
+	}},
+	{"IMAGE_DIR", "directory of photos", func(c *Config, v string) error {
+		c.ImageDir = v
+		return nil
+	}},
+	{"ROTATION", "shuffle, visitor, weighted, daily or page", func(c *Config, v string) error {
+		c.Images.Rotation = Rotation(v)
+		return nil
+	}},
+	{"ALLOW_DEGRADED", "serve even when some assets fail to load", func(c *Config, v string) error {
+		return setBool(&c.AllowDegraded, v)
+	}},
+	{"RELOAD_INTERVAL", "how often to check files for changes", func(c *Config, v string) error {
+		return setDuration(&c.ReloadInterval, v)
+	}},
+	{"SHUTDOWN_TIMEOUT", "how long to wait for requests on shutdown", func(c *Config, v string) error {
+		return setDuration(&c.ShutdownTimeout, v)
+	}},
+	{"STATS_FILE", "file the stats are saved to", func(c *Config, v string) error {
+		c.Stats.File = v
+		return nil
+	}},
+	{"STATS_FLUSH_INTERVAL", "how often to save the stats", func(c *Config, v string) error {
+		return setDuration(&c.Stats.FlushInterval, v)
+	}},
+	{"IP_MODE", "raw, truncated, hashed or off", func(c *Config, v string) error {
+		c.Stats.IPMode = IPMode(v)
+		return nil
+	}},
+	{"MAX_IPS", "number of addresses to keep counts for", func(c *Config, v string) error {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("not a number: %q", v)
+		}
+		c.Stats.MaxIPs = n
+		return nil
+	}},
+	{"ACME", "serve HTTPS with certificates from ACME", func(c *Config, v string) error {
+		return setBool(&c.TLS.ACME, v)
+	}},
+	{"ACME_HOSTS", "comma separated host names to get certificates for", func(c *Config, v string) error {
+		c.TLS.Hosts = strings.Split(v, ",")
+		return nil
+	}},
+	{"ACME_EMAIL", "contact address for the ACME account", func(c *Config, v string) error {
+		c.TLS.Email = v
+		return nil
+	}},
+	{"ACME_CACHE_DIR", "directory certificates are kept in", func(c *Config, v string) error {
+		c.TLS.CacheDir = v
+		return nil
+	}},
+	{"ACME_DIRECTORY_URL", "ACME directory of the CA", func(c *Config, v string) error {
+		c.TLS.DirectoryURL = v
+		return nil
+	}},
+	{"ADMIN_USER", "user for /admin", func(c *Config, v string) error {
+		c.Admin.User = v
+		return nil
+	}},
+	{"ADMIN_PASSWORD", "password for /admin", func(c *Config, v string) error {
+		c.Admin.Password = v
+		return nil
+	}},
+}
+
+func setDuration(d *time.Duration, v string) error {
+	parsed, err := time.ParseDuration(v)
+	if err != nil {
+		return fmt.Errorf("not a duration: %q", v)
+	}
+	*d = parsed
+	return nil
+}
+
+func setBool(b *bool, v string) error {
+	parsed, err := strconv.ParseBool(v)
+	if err != nil {
+		return fmt.Errorf("not a boolean: %q", v)
+	}
+	*b = parsed
+	return nil
+}
+
+func (o override) flag() string {
+	return strings.ReplaceAll(strings.ToLower(o.env), "_", "-")
+}
+
+// loadConfig builds the config from defaults, the file named by -config or
+// CONFIG_FILE, the environment and args, in that order.
+func loadConfig(args []string) (Config, error) {
+	cfg := defaultConfig()
+
+	fs := flag.NewFlagSet("go-website", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("CONFIG_FILE"), "YAML config file")
+	flagValues := map[string]*string{}
+	for _, o := range overrides {
+		flagValues[o.flag()] = fs.String(o.flag(), "", fmt.Sprintf("%v (env %v)", o.usage, o.env))
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if *configFile != "" {
+		data, err := ioutil.ReadFile(*configFile)
+		if err != nil {
+			return cfg, err
+		}
+		// yaml merges into a map that is already there, and the strict
+		// decoder then refuses every key the defaults already have. Files
+		// listed in the config file replace the defaults; cache_control
+		// only overrides the classes it names.
+		defaultFiles, defaultCacheControl := cfg.Files, cfg.CacheControl
+		cfg.Files, cfg.CacheControl = nil, nil
+		if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("%v: %v", *configFile, err)
+		}
+		if cfg.Files == nil {
+			cfg.Files = defaultFiles
+		}
+		if cfg.CacheControl == nil {
+			cfg.CacheControl = map[string]string{}
+		}
+		for class, value := range defaultCacheControl {
+			if _, ok := cfg.CacheControl[class]; !ok {
+				cfg.CacheControl[class] = value
+			}
+		}
+	}
+
+	for _, o := range overrides {
+		if v, ok := os.LookupEnv(o.env); ok {
+			if err := o.set(&cfg, v); err != nil {
+				return cfg, fmt.Errorf("%v: %v", o.env, err)
+			}
+		}
+	}
+
+	var flagErr error
+	fs.Visit(func(f *flag.Flag) {
+		for _, o := range overrides {
+			if o.flag() == f.Name && flagErr == nil {
+				if err := o.set(&cfg, *flagValues[f.Name]); err != nil {
+					flagErr = fmt.Errorf("-%v: %v", f.Name, err)
+				}
+			}
+		}
+	})
+	if flagErr != nil {
+		return cfg, flagErr
+	}
+
+	return cfg, cfg.validate()
+}
+
+// validate checks the shape of every setting and reports all the problems
+// at once.
+func (c Config) validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	_, _, err := net.SplitHostPort(c.Addr)
+	check(err == nil, "addr %q must look like host:port or :port", c.Addr)
+	_, err = parseProxies(c.TrustedProxies)
+	check(err == nil, "trusted_proxies: %v", err)
+	base, err := url.Parse(c.BaseURL)
+	check(err == nil && (base.Scheme == "http" || base.Scheme == "https") && base.Host != "" && strings.TrimSuffix(base.Path, "/") == "",
+		"base_url %q must be an http or https URL with no path", c.BaseURL)
+	check(c.Author != "", "author must be set")
+	check(tagAuthority.MatchString(c.TagAuthority), "tag_authority %q must look like example.com,2020", c.TagAuthority)
+	check(c.localBaseURL() || !strings.HasPrefix(c.TagAuthority, "localhost,"),
+		"tag_authority must be set to a domain you own once base_url is not local, feed IDs are built from it")
+	check(c.Template != "", "template must be set")
+	check(c.ContentDir != "", "content_dir must be set")
+	check(c.PostsDir != "", "posts_dir must be set")
+	check(c.PostsPerPage > 0, "posts_per_page must be at least 1")
+	check(c.BuildDir != "", "build_dir must be set")
+	check(c.ImageDir != "", "image_dir must be set")
+	check(isRoute(c.ImageRoute), "image_route %q must start with /", c.ImageRoute)
+	check(isRoute(c.Home) && c.Home != "/", "home %q must be a route other than /", c.Home)
+	for from, to := range c.Redirects {
+		check(isRoute(from) && from != "/", "redirects: %q must be a route other than /", from)
+		check(to != "" && to != from, "redirects: %q must go somewhere else", from)
+	}
+	for route, file := range c.Files {
+		check(isRoute(route), "files: route %q must start with /", route)
+		check(file != "", "files: route %q has no file", route)
+	}
+	check(len(c.Favicons) > 0, "favicons must list at least one file")
+	check(len(c.Images.Widths) > 0, "images.widths must list at least one width")
+	for i, w := range c.Images.Widths {
+		check(w > 0, "images.widths: %v is not a positive width", w)
+		check(i == 0 || w > c.Images.Widths[i-1], "images.widths must be in increasing order")
+	}
+	check(c.Images.Quality >= 1 && c.Images.Quality <= 100, "images.quality must be between 1 and 100")
+	check(c.Images.CacheDir != "", "images.cache_dir must be set")
+	_, err = newRotator(c.Images.Rotation, nil, nil)
+	check(err == nil, "images.rotation: %v", err)
+	for _, route := range c.Robots.Disallow {
+		check(isRoute(route), "robots.disallow: %q must start with /", route)
+	}
+	for ext, t := range c.MIMETypes {
+		check(strings.HasPrefix(ext, ".") && ext == strings.ToLower(ext), "mime_types: %q must be a lower case extension like .css", ext)
+		_, _, err := mime.ParseMediaType(t)
+		check(err == nil, "mime_types: %q is not a media type: %v", t, err)
+	}
+	for class := range c.CacheControl {
+		check(isAssetClass(class), "cache_control: unknown class %q, want one of %v", class, strings.Join(assetClasses, ", "))
+	}
+	check(c.ReloadInterval > 0, "reload_interval must be positive")
+	check(c.ShutdownTimeout > 0, "shutdown_timeout must be positive")
+	check(c.Stats.File != "", "stats.file must be set")
+	check(c.Stats.FlushInterval > 0, "stats.flush_interval must be positive")
+	_, err = newIPAnonymizer(c.Stats.IPMode)
+	check(err == nil, "stats.ip_mode: %v", err)
+	check(c.Stats.MaxIPs > 0, "stats.max_ips must be at least 1")
+	check((c.Admin.User == "") == (c.Admin.Password == ""), "admin user and password must be set together")
+	if c.TLS.ACME {
+		check(len(c.TLS.Hosts) > 0, "tls.hosts must list the host names to get certificates for")
+		for _, host := range c.TLS.Hosts {
+			check(host != "" && !strings.ContainsAny(host, ":/"), "tls.hosts: %q is not a host name", host)
+		}
+		check(c.TLS.CacheDir != "", "tls.cache_dir must be set")
+		check(c.TLS.DirectoryURL != "", "tls.directory_url must be set")
+		_, _, err = net.SplitHostPort(c.TLS.HTTPAddr)
+		check(err == nil, "tls.http_addr %q must look like host:port or :port", c.TLS.HTTPAddr)
+		_, _, err = net.SplitHostPort(c.TLS.HTTPSAddr)
+		check(err == nil, "tls.https_addr %q must look like host:port or :port", c.TLS.HTTPSAddr)
+		check(c.TLS.HSTSMaxAge >= 0, "tls.hsts_max_age can't be negative")
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config:\n\t%v", strings.Join(problems, "\n\t"))
+	}
+	return nil
+}
+
+// tagAuthority is the tagging entity of a tag: URI, a domain or email
+// address and a date.
+var tagAuthority = regexp.MustCompile(`^[A-Za-z0-9.@-]+,\d{4}(-\d{2}){0,2}$`)
+
+// localBaseURL reports whether the site only links to this machine, which
+// is fine to try things out but never what a deployment wants.
+func (c Config) localBaseURL() bool {
+	base, err := url.Parse(c.BaseURL)
+	if err != nil {
+		return false
+	}
+	host := base.Hostname()
+	return host == "localhost" || net.ParseIP(host).IsLoopback()
+}
+
+func isAssetClass(class string) bool {
+	for _, c := range assetClasses {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+func isRoute(s string) bool {
+	return strings.HasPrefix(s, "/")
+}
+
+// watchDirs are the directories watchSite polls for changes.
+func (c Config) watchDirs() []string {
+	seen := map[string]bool{}
+	var dirs []string
+	add := func(dir string) {
+		if !seen[dir] {
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+
+	add(filepath.Dir(c.Template))
+	add(c.ContentDir)
+	add(c.PostsDir)
+	add(c.ImageDir)
+	for _, file := range c.Files {
+		add(filepath.Dir(file))
+	}
+	for _, file := range c.Favicons {
+		add(filepath.Dir(file))
+	}
+	return dirs
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExampleConfigLoads(t *testing.T) {
+	cfg, err := loadConfig([]string{"-config", "config.example.yaml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The example says it lists the defaults. An empty list in it and a
+	// nil one in the defaults mean the same, and print the same.
+	got, want := fmt.Sprintf("%+v", cfg), fmt.Sprintf("%+v", defaultConfig())
+	if got != want {
+		t.Errorf("config.example.yaml differs from the defaults:\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestCacheControlOverridesOneClass(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(file, []byte("cache_control: {file: no-store}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig([]string{"-config", file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.CacheControl[classFile]; got != "no-store" {
+		t.Errorf("file is %q, want no-store", got)
+	}
+	for class, want := range defaultConfig().CacheControl {
+		if got := cfg.CacheControl[class]; class != classFile && got != want {
+			t.Errorf("%v is %q, want the default %q", class, got, want)
+		}
+	}
+}
@@ -1,113 +1,263 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"html/template"
 	"io"
-	"math/rand"
-	"text/template"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/labstack/echo"
+	"gopkg.in/yaml.v2"
 )
 
 type Page struct {
 	ImgInfo
 	PageContent
+	Meta Meta
 }
 
+// PageContent is one page of the content directory. Subhead is text and
+// is escaped when rendered. Subcontent and Content are HTML: they are
+// kept as written only if the page's front matter says html: true, and
+// escaped when the page is loaded otherwise.
 type PageContent struct {
 	Subhead        string
 	ShowSubcontent bool
-	Subcontent     string
-	Content        []string
+	Subcontent     template.HTML
+	Content        []Item
+	// ModTime is when the page's file last changed.
+	ModTime time.Time
+	// Title, Description, Canonical and Image describe the page to search
+	// engines and link previews. Canonical and Image may be routes.
+	// ImageAlt describes Image; a photo's own alt text is used without it.
+	Title       string
+	Description string
+	Canonical   string
+	Image       string
+	ImageAlt    string
+	// Person is set on the page about the site's author.
+	Person *personFrontMatter
 }
 
-var masterTemplate *template.Template
-
-var images = []ImgInfo{}
-
-var pages = map[string]PageContent{
-	"/about": {
-		Subhead:        "About",
-		ShowSubcontent: true,
-		Subcontent:     `Hi, my name is Nathan Mannes. I write <a href="https://golang.org">Go</a> at <a href="https://sezzle.com">Sezzle</a>. I grew up in New York City. I live in Minneapolis.`,
-		Content: []string{
-			`I like programming computers, ultimate frisbee, tennis, reading non-fiction, and other stuff too but I'll leave it at that for now`,
-			`I graduated from Carleton College in 2019 with a degree in Computer Science`,
-			`My tech work experience is detailed on my <a href="/resume">resume</a>`,
-		},
-	},
-	"/news": {
-		Subhead: "Nathan in the news",
-		Content: []string{
-			`In 2012, I was quoted in a local news article about NYC getting back to normal after <a href="https://www.cbsnews.com/news/nyc-area-schools-return-to-life-post-sandy/">
-			hurricane Sandy</a>`,
-			` In 2008, a piece of music that I wrote was <a href="https://www.nytimes.com/2008/01/14/arts/music/14youn.html">
-			reviewed</a>`,
-		},
-	},
-	"/history": {
-		Subhead: "Major (and Minor) life events",
-		Content: []string{
-
-			`My grandma teaches me how to play tennis in 2003`,
-
-			`In 2006 I am cast for a minor role in my <a href="https://www.schools.nyc.gov/schools/M199">elementary
-			school</a>'s production of Pinnochio. I have no lines. It is a great success`,
-
-			`In 2013, I first take a coding class at my <a href="https://stuy.enschool.org">high school</a>.
-			It culminates in my creation of a reversi bot that is good enough to beat my dad`,
-
-			`In the academic year of 2017-2018 I take 3 geology
-			classes. I know more about rocks than I ever thought I wanted to`,
-
-			`It is February of 2018. I get a call from an HR person at <a href="http://factset.com">Factset</a>.
-			It turns out I did not blow the onsite interview. I accept this offer over the phone. I have gotten my first legit tech job`,
-
-			` It is June 22nd, 2018. I am on a flight to Cleveland to visit my grandparents. I did not bring anything to do on the flight. I am sitting next to my brother. He is reading <a href="https://www.goodreads.com/book/show/1111.The_Power_Broker">this book</a>.
-			He tells me to read the first chapter. I am happy. I have found something to do on the flight. I finish the book 6 months later`,
-
-			`I graduate college June 8th, 2019`,
-
-			`September 1st, 2019 I move to Minneapolis`,
-
-			`September 11th, 2019 I start my second legit tech job at <a href="https://sezzle.com">Sezzle</a>`,
-
-			`October 8th, 2019 I begin a tradition of bowling every Tuesday night with a few of my friends at <a href="https://www.bryantlakebowl.com">my local bowling alley</a>`,
-
-			`In February, to occupy time at home, I learn how to make pierogies using <a href="https://www.kingarthurbaking.com/recipes/homemade-pierogi-recipe">this recipe</a>`,
-
-			`Bowling night is on hiatus as of March 10th, 2020`,
-
-			`To celebrate the new year (and so he can practice his video editing skills), my dad releases a <a href="https://www.youtube.com/watch?v=QA0kvDKreZc">video of me making pierogies</a>`,
-		},
-	},
-	"/links": {
-
-		Subhead: "Links to other info",
-		Content: []string{
-			`<a href="/resume">resume</a>`,
-			`<a href="https://github.com/nmannes">github</a>`,
-			`<a href="https://www.goodreads.com/user/show/48641482-nathan-mannes">goodreads</a>`,
-			`<a href="https://linkedin.com/in/nathan-mannes">linkedin</a>`,
-			`<a href="https://github.com/nmannes/go-website">the code for this website</a>`,
-		},
-	},
+// Item is one entry of a page's list. An item that starts with a date in
+// parentheses, like "- (2019-06-08) I graduate", is dated: the date is cut
+// from the text, and the item gets an anchor so feeds can link to it.
+// Items on the same date need a name after it to tell them apart, like
+// "- (2019-06-08 party)", which makes the anchor 2019-06-08-party.
+type Item struct {
+	Text   template.HTML
+	Date   time.Time
+	Anchor string
+}
+
+// frontMatter is the YAML header at the top of every file in the content
+// directory.
+type frontMatter struct {
+	Subhead        string `yaml:"subhead"`
+	ShowSubcontent bool   `yaml:"show_subcontent"`
+	Subcontent     string `yaml:"subcontent"`
+	// HTML marks the body and subcontent as trusted HTML.
+	HTML bool `yaml:"html"`
+
+	Title       string             `yaml:"title"`
+	Description string             `yaml:"description"`
+	Canonical   string             `yaml:"canonical"`
+	Image       string             `yaml:"image"`
+	ImageAlt    string             `yaml:"image_alt"`
+	Person      *personFrontMatter `yaml:"person"`
+}
+
+const frontMatterDelim = "---"
+
+// itemDate matches the date, and the name if there is one, at the start of
+// a dated list item.
+var itemDate = regexp.MustCompile(`^\((\d{4}(?:-\d{2}){0,2})(?: ([a-z0-9-]+))?\)\s+`)
+
+// parseItemDate reads a date that may leave out the day, or the month and
+// the day, for events that aren't remembered that exactly.
+func parseItemDate(s string) (time.Time, error) {
+	for _, layout := range []string{dateLayout, "2006-01", "2006"} {
+		if date, err := time.Parse(layout, s); err == nil {
+			return date, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("date %q should look like 2006-01-02, 2006-01 or 2006", s)
+}
+
+// loadPages builds the page registry from the markdown files in dir. A file
+// named history.md is served at /history. A page that can't be loaded is a
+// fatal problem, since its route would turn into a 404, and so is not having
+// a page at home.
+func loadPages(dir, home string, report *LoadReport) map[string]PageContent {
+	registry := map[string]PageContent{}
+
+	if _, err := os.Stat(dir); err != nil {
+		report.add("content", dir, err, true)
+		return registry
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.md"))
+	if err != nil {
+		report.add("content", dir, err, true)
+		return registry
+	}
+
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			report.add("content", file, err, true)
+			continue
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			report.add("content", file, err, true)
+			continue
+		}
+
+		pageContent, err := parsePage(data)
+		if err != nil {
+			report.add("content", file, err, true)
+			continue
+		}
+		pageContent.ModTime = info.ModTime()
+
+		route := "/" + strings.TrimSuffix(filepath.Base(file), ".md")
+		registry[route] = pageContent
+	}
+
+	if _, ok := registry[home]; !ok {
+		report.add("content", filepath.Join(dir, strings.TrimPrefix(home, "/")+".md"), fmt.Errorf("missing, it is the home page"), true)
+	}
+
+	return registry
+}
+
+// splitFrontMatter reads the YAML front matter at the top of a content file
+// into fm and returns the rest of the file.
+func splitFrontMatter(data []byte, fm interface{}) (string, error) {
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	if !strings.HasPrefix(text, frontMatterDelim+"\n") {
+		return "", fmt.Errorf("missing front matter")
+	}
+
+	parts := strings.SplitN(text[len(frontMatterDelim)+1:], "\n"+frontMatterDelim+"\n", 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("unterminated front matter")
+	}
+
+	if err := yaml.UnmarshalStrict([]byte(parts[0]), fm); err != nil {
+		return "", err
+	}
+	return parts[1], nil
+}
+
+// trust keeps s as written when its file is marked html: true, and escapes
+// it otherwise.
+func trust(html bool, s string) template.HTML {
+	if html {
+		return template.HTML(s)
+	}
+	return template.HTML(template.HTMLEscapeString(s))
+}
+
+// parsePage splits a content file into its front matter and body. Each item
+// of the markdown list in the body becomes one entry of Content; indented
+// lines continue the item above them.
+func parsePage(data []byte) (PageContent, error) {
+	var fm frontMatter
+	body, err := splitFrontMatter(data, &fm)
+	if err != nil {
+		return PageContent{}, err
+	}
+
+	pageContent := PageContent{
+		Subhead:        fm.Subhead,
+		ShowSubcontent: fm.ShowSubcontent,
+		Subcontent:     trust(fm.HTML, fm.Subcontent),
+		Content:        []Item{},
+		Title:          fm.Title,
+		Description:    fm.Description,
+		Canonical:      fm.Canonical,
+		Image:          fm.Image,
+		ImageAlt:       fm.ImageAlt,
+		Person:         fm.Person,
+	}
+
+	var items []string
+	for _, line := range strings.Split(body, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+		case strings.HasPrefix(line, "- "), strings.HasPrefix(line, "* "):
+			items = append(items, trimmed[2:])
+		case line != trimmed && len(items) > 0:
+			items[len(items)-1] += " " + trimmed
+		default:
+			return PageContent{}, fmt.Errorf("unexpected line outside of a list item: %q", trimmed)
+		}
+	}
+	anchors := map[string]bool{}
+	for _, text := range items {
+		var item Item
+		if m := itemDate.FindStringSubmatch(text); m != nil {
+			date, err := parseItemDate(m[1])
+			if err != nil {
+				return PageContent{}, err
+			}
+			item.Date = date
+			// Numbering items on the same date would change their anchors,
+			// and with them their feed IDs, whenever one is added above.
+			item.Anchor = m[1]
+			if m[2] != "" {
+				item.Anchor += "-" + m[2]
+			}
+			if anchors[item.Anchor] {
+				return PageContent{}, fmt.Errorf("more than one item is dated %v, name them apart like (%v party)", item.Anchor, m[1])
+			}
+			anchors[item.Anchor] = true
+			text = text[len(m[0]):]
+		}
+		item.Text = trust(fm.HTML, text)
+		pageContent.Content = append(pageContent.Content, item)
+	}
+
+	return pageContent, nil
 }
 
 func Route(e echo.Context) error {
 
 	path := e.Request().URL.Path
+	s := currentSite()
+
+	// Fingerprinted asset URLs change on every reload, so they can't have
+	// routes of their own.
+	if _, ok := s.blobs[path]; ok {
+		return serveBlob(e)
+	}
 
-	pageContent, ok := pages[path]
+	pageContent, ok := s.pages[path]
 	if !ok {
-		pageContent = pages["/about"]
+		return echo.ErrNotFound
 	}
 
-	return RenderPage(e.Response().Writer, masterTemplate, Page{
+	var buf bytes.Buffer
+	err := RenderPage(&buf, s.template, Page{
 		PageContent: pageContent,
-
-		// TODO: make it so that you dont' get the same image twice in a row from the rng
-		ImgInfo: images[rand.Intn(len(images))],
+		ImgInfo:     s.photo(e),
+		Meta:        s.pageMeta(e, path, pageContent),
 	})
+	if err != nil {
+		return err
+	}
+
+	return writeHTML(e, http.StatusOK, buf.Bytes())
 }
 
 func RenderPage(w io.Writer, t *template.Template, p Page) error {
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const attack = `<script>alert(1)</script>`
+
+// jsonLD is the one script the layout writes itself.
+var jsonLD = regexp.MustCompile(`(?s)<script type="application/ld\+json">.*?</script>`)
+
+func testTemplates(t *testing.T) *site {
+	s := &site{
+		views:        map[string]*template.Template{},
+		fingerprints: map[string]string{},
+	}
+	var report LoadReport
+	loadTemplates(s, defaultConfig().Template, &report)
+	if !report.OK() {
+		t.Fatal(report)
+	}
+	return s
+}
+
+// testMeta puts the attack in everything the head of a page shows,
+// the JSON-LD block included.
+func testMeta() Meta {
+	return Meta{
+		SiteName:    attack,
+		Title:       attack,
+		Description: attack,
+		Person: &Person{
+			Context: "https://schema.org",
+			Type:    "Person",
+			Name:    attack,
+		},
+	}
+}
+
+func checkEscaped(t *testing.T, html string) {
+	t.Helper()
+	if !strings.Contains(html, "&lt;script&gt;") {
+		t.Errorf("escaped script missing from:\n%v", html)
+	}
+	if rest := jsonLD.ReplaceAllString(html, ""); strings.Contains(strings.ToLower(rest), "<script") {
+		t.Errorf("raw script outside of the JSON-LD block:\n%v", rest)
+	}
+	if strings.Count(html, "<script") != 1 {
+		t.Errorf("the attack broke out of the JSON-LD block:\n%v", html)
+	}
+}
+
+func TestPageEscapesUntrustedContent(t *testing.T) {
+	s := testTemplates(t)
+	content, err := parsePage([]byte("---\n" +
+		"subhead: \"" + attack + "\"\n" +
+		"show_subcontent: true\n" +
+		"subcontent: \"" + attack + "\"\n" +
+		"---\n" +
+		"- (2019-06-08) " + attack + "\n" +
+		"- plain " + attack + "\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := RenderPage(&buf, s.template, Page{PageContent: content, Meta: testMeta()}); err != nil {
+		t.Fatal(err)
+	}
+	checkEscaped(t, buf.String())
+}
+
+func TestPostEscapesUntrustedContent(t *testing.T) {
+	s := testTemplates(t)
+	post, _, err := parsePost("attack", []byte("---\n"+
+		"title: \""+attack+"\"\n"+
+		"date: 2020-01-02\n"+
+		"---\n"+
+		attack+"\n\n"+
+		"second "+attack+"\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := s.views["post"].Execute(&buf, postPage{Post: post, Meta: testMeta()}); err != nil {
+		t.Fatal(err)
+	}
+	checkEscaped(t, buf.String())
+}
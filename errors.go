@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/labstack/echo"
+)
+
+// errorPage is the data for the error view.
+type errorPage struct {
+	ImgInfo
+	Code    int
+	Title   string
+	Message string
+	Meta    Meta
+}
+
+// errorMessages explain the errors a visitor is likely to run into. Others
+// only get their status text.
+var errorMessages = map[int]string{
+	http.StatusNotFound:            "There's nothing here. The page may have moved, or the link may have a typo in it.",
+	http.StatusMethodNotAllowed:    "This page can only be read.",
+	http.StatusUnauthorized:        "This page needs a password.",
+	http.StatusInternalServerError: "Something broke on my end. Try again in a bit.",
+}
+
+// httpErrorHandler renders errors as pages in the site's layout. Errors that
+// aren't an *echo.HTTPError are bugs, so they are logged and shown as a 500.
+func httpErrorHandler(logf func(format string, args ...interface{})) echo.HTTPErrorHandler {
+	return func(err error, c echo.Context) {
+		code := http.StatusInternalServerError
+		if he, ok := err.(*echo.HTTPError); ok {
+			code = he.Code
+			if he.Internal != nil {
+				logf("%v %v: %v: %v", c.Request().Method, c.Request().URL.Path, err, he.Internal)
+			}
+		} else {
+			logf("%v %v: %v", c.Request().Method, c.Request().URL.Path, err)
+		}
+
+		if c.Response().Committed {
+			return
+		}
+		if c.Request().Method == http.MethodHead {
+			c.NoContent(code)
+			return
+		}
+
+		if err := renderError(c, code); err != nil {
+			logf("rendering the %v page: %v", code, err)
+			c.String(code, http.StatusText(code))
+		}
+	}
+}
+
+func renderError(c echo.Context, code int) error {
+	s := currentSite()
+	meta := s.meta(c, http.StatusText(code), errorMessages[code])
+	meta.URL = ""
+	return s.writeView(c, code, "error", errorPage{
+		ImgInfo: s.photo(c),
+		Code:    code,
+		Title:   http.StatusText(code),
+		Message: errorMessages[code],
+		Meta:    meta,
+	})
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"html/template"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxFeedEntries is how many of the newest entries the feeds carry.
+const maxFeedEntries = 50
+
+// feeds are the routes the feeds are served at, with their content types.
+var feeds = map[string]string{
+	"/feed.atom": "application/atom+xml; charset=utf-8",
+	"/feed.rss":  "application/rss+xml; charset=utf-8",
+	"/feed.json": "application/feed+json; charset=utf-8",
+}
+
+// feedHead is what a feed says about itself.
+type feedHead struct {
+	Base    string
+	ID      string
+	Author  string
+	Updated time.Time
+}
+
+// feedEntry is one post or dated page item, in the shape every feed format
+// is built from.
+type feedEntry struct {
+	// ID is a tag: URI made of the site's tag authority and the entry's
+	// route, date and slug, so it doesn't change when the site moves.
+	ID        string
+	URL       string
+	Title     string
+	Summary   string
+	Content   template.HTML
+	Published time.Time
+	Updated   time.Time
+	Tags      []string
+}
+
+// feedEntries collects the posts and the dated items of every page, newest
+// first.
+func feedEntries(s *site, base, authority string) []feedEntry {
+	var entries []feedEntry
+
+	for _, post := range s.posts {
+		var content []string
+		for _, p := range post.Body {
+			content = append(content, "<p>"+string(p)+"</p>")
+		}
+		entries = append(entries, feedEntry{
+			ID:        tagURI(authority, "posts/"+post.Date.Format(dateLayout)+"/"+post.Slug),
+			URL:       base + "/posts/" + post.Slug,
+			Title:     post.Title,
+			Summary:   post.Summary,
+			Content:   template.HTML(strings.Join(content, "\n")),
+			Published: post.Date,
+			Updated:   post.Updated,
+			Tags:      post.Tags,
+		})
+	}
+
+	for route, page := range s.pages {
+		for _, item := range page.Content {
+			if item.Anchor == "" {
+				continue
+			}
+			// The anchor starts with the item's date.
+			entries = append(entries, feedEntry{
+				ID:        tagURI(authority, strings.TrimPrefix(route, "/")+"/"+item.Anchor),
+				URL:       base + route + "#" + item.Anchor,
+				Title:     headline(plainText(item.Text)),
+				Content:   item.Text,
+				Published: item.Date,
+				Updated:   item.Date,
+				Tags:      []string{strings.TrimPrefix(route, "/")},
+			})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].Updated.Equal(entries[j].Updated) {
+			return entries[i].Updated.After(entries[j].Updated)
+		}
+		return entries[i].ID < entries[j].ID
+	})
+	if len(entries) > maxFeedEntries {
+		entries = entries[:maxFeedEntries]
+	}
+	return entries
+}
+
+// tagURI names specific under authority, see RFC 4151.
+func tagURI(authority, specific string) string {
+	return "tag:" + authority + ":" + specific
+}
+
+var tags = regexp.MustCompile(`<[^>]*>`)
+
+// plainText strips the markup from h.
+func plainText(h template.HTML) string {
+	return strings.Join(strings.Fields(html.UnescapeString(tags.ReplaceAllString(string(h), ""))), " ")
+}
+
+// headline is the first sentence of text, cut short at a word if it runs
+// long.
+func headline(text string) string {
+	if i := strings.Index(text, ". "); i >= 0 {
+		text = text[:i]
+	}
+	return truncate(strings.TrimSuffix(text, "."), 80)
+}
+
+// setFeeds renders every feed and serves it like a file, so feed readers
+// get ETags and Last-Modified to poll with.
+func setFeeds(s *site, cfg Config, report *LoadReport) {
+	entries := feedEntries(s, s.baseURL, cfg.TagAuthority)
+
+	head := feedHead{
+		Base:    s.baseURL,
+		ID:      tagURI(cfg.TagAuthority, "feed"),
+		Author:  cfg.Author,
+		Updated: time.Now().UTC().Truncate(time.Second),
+	}
+	if len(entries) > 0 {
+		head.Updated = entries[0].Updated
+	}
+
+	render := map[string]func(feedHead, []feedEntry) ([]byte, error){
+		"/feed.atom": atomFeed,
+		"/feed.rss":  rssFeed,
+		"/feed.json": jsonFeed,
+	}
+	for route, contentType := range feeds {
+		data, err := render[route](head, entries)
+		if err != nil {
+			report.add("feed", route, err, false)
+			continue
+		}
+		s.blobs[route] = newBlob(data, contentType, head.Updated, s.cacheControl[classFile])
+	}
+}
+
+type (
+	atomLink struct {
+		Rel  string `xml:"rel,attr,omitempty"`
+		Type string `xml:"type,attr,omitempty"`
+		Href string `xml:"href,attr"`
+	}
+
+	atomText struct {
+		Type string `xml:"type,attr,omitempty"`
+		Body string `xml:",chardata"`
+	}
+
+	atomCategory struct {
+		Term string `xml:"term,attr"`
+	}
+
+	atomEntry struct {
+		ID         string         `xml:"id"`
+		Title      string         `xml:"title"`
+		Updated    string         `xml:"updated"`
+		Published  string         `xml:"published"`
+		Link       atomLink       `xml:"link"`
+		Summary    *atomText      `xml:"summary,omitempty"`
+		Content    atomText       `xml:"content"`
+		Categories []atomCategory `xml:"category"`
+	}
+)
+
+func atomFeed(head feedHead, entries []feedEntry) ([]byte, error) {
+	feed := struct {
+		XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+		ID      string      `xml:"id"`
+		Title   string      `xml:"title"`
+		Updated string      `xml:"updated"`
+		Author  string      `xml:"author>name"`
+		Links   []atomLink  `xml:"link"`
+		Entries []atomEntry `xml:"entry"`
+	}{
+		ID:      head.ID,
+		Title:   head.Author,
+		Updated: head.Updated.Format(time.RFC3339),
+		Author:  head.Author,
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: head.Base + "/feed.atom"},
+			{Rel: "alternate", Type: "text/html", Href: head.Base + "/"},
+		},
+	}
+
+	for _, e := range entries {
+		entry := atomEntry{
+			ID:        e.ID,
+			Title:     e.Title,
+			Updated:   e.Updated.Format(time.RFC3339),
+			Published: e.Published.Format(time.RFC3339),
+			Link:      atomLink{Rel: "alternate", Type: "text/html", Href: e.URL},
+			Content:   atomText{Type: "html", Body: string(e.Content)},
+		}
+		if e.Summary != "" {
+			entry.Summary = &atomText{Type: "text", Body: e.Summary}
+		}
+		for _, tag := range e.Tags {
+			entry.Categories = append(entry.Categories, atomCategory{Term: tag})
+		}
+		feed.Entries = append(feed.Entries, entry)
+	}
+
+	return marshalXML(feed)
+}
+
+type rssItem struct {
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	GUID        rssGUID  `xml:"guid"`
+	PubDate     string   `xml:"pubDate"`
+	Description string   `xml:"description"`
+	Categories  []string `xml:"category"`
+}
+
+// rssGUID is an ID that isn't a link, which RSS assumes unless told.
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	ID          string `xml:",chardata"`
+}
+
+func rssFeed(head feedHead, entries []feedEntry) ([]byte, error) {
+	type channel struct {
+		Title         string    `xml:"title"`
+		Link          string    `xml:"link"`
+		Description   string    `xml:"description"`
+		LastBuildDate string    `xml:"lastBuildDate"`
+		Self          atomLink  `xml:"http://www.w3.org/2005/Atom link"`
+		Items         []rssItem `xml:"item"`
+	}
+	feed := struct {
+		XMLName xml.Name `xml:"rss"`
+		Version string   `xml:"version,attr"`
+		Channel channel  `xml:"channel"`
+	}{
+		Version: "2.0",
+		Channel: channel{
+			Title:         head.Author,
+			Link:          head.Base + "/",
+			Description:   fmt.Sprintf("Posts and news from %v", head.Author),
+			LastBuildDate: head.Updated.Format(time.RFC1123Z),
+			Self:          atomLink{Rel: "self", Type: "application/rss+xml", Href: head.Base + "/feed.rss"},
+		},
+	}
+
+	for _, e := range entries {
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       e.Title,
+			Link:        e.URL,
+			GUID:        rssGUID{ID: e.ID},
+			PubDate:     e.Published.Format(time.RFC1123Z),
+			Description: string(e.Content),
+			Categories:  e.Tags,
+		})
+	}
+
+	return marshalXML(feed)
+}
+
+func marshalXML(v interface{}) ([]byte, error) {
+	data, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+type jsonFeedItem struct {
+	ID            string   `json:"id"`
+	URL           string   `json:"url"`
+	Title         string   `json:"title"`
+	ContentHTML   string   `json:"content_html"`
+	Summary       string   `json:"summary,omitempty"`
+	DatePublished string   `json:"date_published"`
+	DateModified  string   `json:"date_modified"`
+	Tags          []string `json:"tags,omitempty"`
+}
+
+func jsonFeed(head feedHead, entries []feedEntry) ([]byte, error) {
+	type person struct {
+		Name string `json:"name"`
+		URL  string `json:"url"`
+	}
+	feed := struct {
+		Version     string         `json:"version"`
+		Title       string         `json:"title"`
+		HomePageURL string         `json:"home_page_url"`
+		FeedURL     string         `json:"feed_url"`
+		Authors     []person       `json:"authors"`
+		Items       []jsonFeedItem `json:"items"`
+	}{
+		Version:     "https://jsonfeed.org/version/1.1",
+		Title:       head.Author,
+		HomePageURL: head.Base + "/",
+		FeedURL:     head.Base + "/feed.json",
+		Authors:     []person{{Name: head.Author, URL: head.Base + "/"}},
+		Items:       []jsonFeedItem{},
+	}
+
+	for _, e := range entries {
+		feed.Items = append(feed.Items, jsonFeedItem{
+			ID:            e.ID,
+			URL:           e.URL,
+			Title:         e.Title,
+			ContentHTML:   string(e.Content),
+			Summary:       e.Summary,
+			DatePublished: e.Published.Format(time.RFC3339),
+			DateModified:  e.Updated.Format(time.RFC3339),
+			Tags:          e.Tags,
+		})
+	}
+
+	return json.MarshalIndent(feed, "", "\t")
+}
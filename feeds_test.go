@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testHistory = "---\nsubhead: History\n---\n" +
+	"- (2019-06-08) I graduate college. It rains\n" +
+	"- (2019-06-08 party) We have a party\n" +
+	"- (2003) I start school\n" +
+	"- Not dated\n"
+
+func testFeeds(t *testing.T, base string) map[string][]byte {
+	t.Helper()
+	post, _, err := parsePost("hello", []byte("---\ntitle: Hello\ndate: 2020-01-02\nsummary: The first post.\n---\nHi there.\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err := parsePage([]byte(testHistory))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &site{
+		pages:   map[string]PageContent{"/history": history},
+		posts:   []Post{post},
+		blobs:   map[string]blob{},
+		baseURL: base,
+	}
+	cfg := defaultConfig()
+	cfg.TagAuthority = "example.com,2020"
+	var report LoadReport
+	setFeeds(s, cfg, &report)
+	if !report.OK() {
+		t.Fatal(report)
+	}
+
+	out := map[string][]byte{}
+	for route := range feeds {
+		out[route] = s.blobs[route].data
+	}
+	return out
+}
+
+type testAtom struct {
+	XMLName xml.Name `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string   `xml:"id"`
+	Title   string   `xml:"title"`
+	Updated string   `xml:"updated"`
+	Author  string   `xml:"author>name"`
+	Entries []struct {
+		ID      string `xml:"id"`
+		Title   string `xml:"title"`
+		Updated string `xml:"updated"`
+	} `xml:"entry"`
+}
+
+func TestAtomFeed(t *testing.T) {
+	var feed testAtom
+	if err := xml.Unmarshal(testFeeds(t, "https://example.com")["/feed.atom"], &feed); err != nil {
+		t.Fatal(err)
+	}
+
+	checkTag(t, "feed id", feed.ID)
+	checkSet(t, "feed title", feed.Title)
+	checkSet(t, "feed author", feed.Author)
+	checkTime(t, "feed updated", time.RFC3339, feed.Updated)
+	if len(feed.Entries) != 4 {
+		t.Fatalf("got %v entries, want the post and 3 dated items", len(feed.Entries))
+	}
+	ids := map[string]bool{}
+	for _, e := range feed.Entries {
+		checkTag(t, "entry id", e.ID)
+		checkSet(t, "entry title", e.Title)
+		checkTime(t, "entry updated", time.RFC3339, e.Updated)
+		if ids[e.ID] {
+			t.Errorf("entry id %v used twice", e.ID)
+		}
+		ids[e.ID] = true
+	}
+}
+
+func TestRSSFeed(t *testing.T) {
+	var feed struct {
+		Channel struct {
+			Title string `xml:"title"`
+			// link also matches the atom:link next to it.
+			Links []struct {
+				XMLName xml.Name
+				Href    string `xml:",chardata"`
+			} `xml:"link"`
+			Description string `xml:"description"`
+			Items       []struct {
+				Title       string `xml:"title"`
+				Description string `xml:"description"`
+				GUID        struct {
+					IsPermaLink string `xml:"isPermaLink,attr"`
+					ID          string `xml:",chardata"`
+				} `xml:"guid"`
+			} `xml:"item"`
+		} `xml:"channel"`
+	}
+	if err := xml.Unmarshal(testFeeds(t, "https://example.com")["/feed.rss"], &feed); err != nil {
+		t.Fatal(err)
+	}
+
+	checkSet(t, "channel title", feed.Channel.Title)
+	link := ""
+	for _, l := range feed.Channel.Links {
+		if l.XMLName.Space == "" {
+			link = l.Href
+		}
+	}
+	checkSet(t, "channel link", link)
+	checkSet(t, "channel description", feed.Channel.Description)
+	if len(feed.Channel.Items) != 4 {
+		t.Fatalf("got %v items, want 4", len(feed.Channel.Items))
+	}
+	for _, item := range feed.Channel.Items {
+		if item.Title == "" && item.Description == "" {
+			t.Errorf("item %v has neither title nor description", item.GUID.ID)
+		}
+		checkTag(t, "guid", item.GUID.ID)
+		if item.GUID.IsPermaLink != "false" {
+			t.Errorf("guid %v isn't a link, but isPermaLink is %q", item.GUID.ID, item.GUID.IsPermaLink)
+		}
+	}
+}
+
+func TestJSONFeed(t *testing.T) {
+	var feed struct {
+		Version string `json:"version"`
+		Title   string `json:"title"`
+		Items   []struct {
+			ID string `json:"id"`
+		} `json:"items"`
+	}
+	if err := json.Unmarshal(testFeeds(t, "https://example.com")["/feed.json"], &feed); err != nil {
+		t.Fatal(err)
+	}
+
+	if feed.Version != "https://jsonfeed.org/version/1.1" {
+		t.Errorf("version %q", feed.Version)
+	}
+	checkSet(t, "title", feed.Title)
+	if len(feed.Items) != 4 {
+		t.Fatalf("got %v items, want 4", len(feed.Items))
+	}
+	for _, item := range feed.Items {
+		checkTag(t, "item id", item.ID)
+	}
+}
+
+func TestFeedIDsDontDependOnBaseURL(t *testing.T) {
+	ids := func(base string) []string {
+		var feed testAtom
+		if err := xml.Unmarshal(testFeeds(t, base)["/feed.atom"], &feed); err != nil {
+			t.Fatal(err)
+		}
+		out := []string{feed.ID}
+		for _, e := range feed.Entries {
+			out = append(out, e.ID)
+		}
+		return out
+	}
+
+	local, moved := ids("http://localhost:8000"), ids("https://example.org")
+	if strings.Join(local, "\n") != strings.Join(moved, "\n") {
+		t.Errorf("ids changed with base_url:\n%v\n%v", local, moved)
+	}
+}
+
+func TestItemAnchorsDontDependOnOrder(t *testing.T) {
+	anchors := func(items ...string) map[string]string {
+		page, err := parsePage([]byte("---\nsubhead: x\n---\n" + strings.Join(items, "\n")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := map[string]string{}
+		for _, item := range page.Content {
+			out[string(item.Text)] = item.Anchor
+		}
+		return out
+	}
+
+	first := anchors("- (2019-06-08) Graduation", "- (2019-06-08 party) Party")
+	second := anchors("- (2019-06-08 party) Party", "- (2019-06-08) Graduation")
+	for text, anchor := range first {
+		if second[text] != anchor {
+			t.Errorf("%q is %v, and %v with the items swapped", text, anchor, second[text])
+		}
+	}
+
+	if _, err := parsePage([]byte("---\nsubhead: x\n---\n- (2019-06-08) One\n- (2019-06-08) Two\n")); err == nil {
+		t.Error("two items on the same date without names should not load")
+	}
+}
+
+func checkSet(t *testing.T, name, value string) {
+	t.Helper()
+	if strings.TrimSpace(value) == "" {
+		t.Errorf("%v is empty", name)
+	}
+}
+
+func checkTag(t *testing.T, name, id string) {
+	t.Helper()
+	if !strings.HasPrefix(id, "tag:example.com,2020:") {
+		t.Errorf("%v %q is not a tag: URI under the tag authority", name, id)
+	}
+}
+
+func checkTime(t *testing.T, name, layout, value string) {
+	t.Helper()
+	if _, err := time.Parse(layout, value); err != nil {
+		t.Errorf("%v: %v", name, err)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/labstack/echo"
+)
+
+type (
+	// photosPage is the data for the photos view.
+	photosPage struct {
+		ImgInfo
+		Photos []ImgInfo
+		Meta   Meta
+	}
+
+	// photoPage is the data for the photo view. Its ImgInfo is the photo
+	// the page is about.
+	photoPage struct {
+		ImgInfo
+		Prev, Next ImgInfo
+		Meta       Meta
+	}
+)
+
+// slugify turns a photo's file name, less its extension, into the last
+// part of its permalink, e.g. "nathan(11)_skies" becomes "nathan-11-skies".
+func slugify(name string) string {
+	slug := strings.FieldsFunc(strings.ToLower(name), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	return strings.Join(slug, "-")
+}
+
+func servePhotos(c echo.Context) error {
+	s := currentSite()
+	return s.writeView(c, http.StatusOK, "photos", photosPage{
+		ImgInfo: s.photo(c),
+		Photos:  s.images,
+		Meta:    s.meta(c, "Photos", fmt.Sprintf("%v photos of %v.", len(s.images), s.person.Name)),
+	})
+}
+
+// servePhoto shows one photo, linking to its neighbours in the index. The
+// first and last photos link around to each other.
+func servePhoto(c echo.Context) error {
+	s := currentSite()
+	for i, photo := range s.images {
+		if photo.Slug != c.Param("slug") {
+			continue
+		}
+
+		var about []string
+		if !photo.Date.IsZero() {
+			about = append(about, photo.Date.Format("January 2, 2006"))
+		}
+		if photo.Location != "" {
+			about = append(about, photo.Location)
+		}
+
+		n := len(s.images)
+		return s.writeView(c, http.StatusOK, "photo", photoPage{
+			ImgInfo: photo,
+			Prev:    s.images[(i+n-1)%n],
+			Next:    s.images[(i+1)%n],
+			Meta:    s.meta(c, photo.Caption, strings.Join(about, ", ")).withPhoto(s.baseURL, photo),
+		})
+	}
+	return echo.ErrNotFound
+}
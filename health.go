@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/echo/middleware"
+)
+
+type (
+	// Health is the readiness report served on /healthz. A degraded site
+	// is still ready, since pages render. What is missing is only listed on
+	// /admin/health, since file paths and parse errors are not for everyone.
+	Health struct {
+		Status   string            `json:"status"`
+		Checks   map[string]string `json:"checks"`
+		Problems []LoadProblem     `json:"problems,omitempty"`
+	}
+)
+
+const (
+	healthOK       = "ok"
+	healthDegraded = "degraded"
+	healthFail     = "failing"
+)
+
+// checkHealth reports whether everything a page needs is loaded and whether
+// the stats store can be reached.
+func checkHealth(s *Stats) Health {
+	h := Health{
+		Status: healthOK,
+		Checks: map[string]string{},
+	}
+	fail := func(check, reason string) {
+		h.Status = healthFail
+		h.Checks[check] = reason
+	}
+
+	h.Checks["template"] = healthOK
+	h.Checks["images"] = healthOK
+	h.Checks["assets"] = healthOK
+	site, _ := current.Load().(*site)
+	switch {
+	case site == nil:
+		fail("template", "site not loaded")
+		fail("images", "site not loaded")
+	case len(site.images) == 0:
+		fail("images", "no images loaded")
+	case !site.report.OK():
+		h.Status = healthDegraded
+		h.Checks["assets"] = healthDegraded
+	}
+
+	h.Checks["store"] = healthOK
+	if err := s.store.Ping(); err != nil {
+		fail("store", err.Error())
+	}
+
+	return h
+}
+
+func serveHealth(s *Stats) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		h := checkHealth(s)
+		return c.JSONPretty(healthStatus(h), h, "\t")
+	}
+}
+
+// serveAdminHealth is /healthz plus the problems found by the last load.
+func serveAdminHealth(s *Stats) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		h := checkHealth(s)
+		if site, _ := current.Load().(*site); site != nil {
+			h.Problems = site.report.Problems
+		}
+		return c.JSONPretty(healthStatus(h), h, "\t")
+	}
+}
+
+func healthStatus(h Health) int {
+	if h.Status == healthFail {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusOK
+}
+
+func serveAdminStats(s *Stats) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		s.mutex.RLock()
+		snapshot := &Stats{
+			Uptime:    s.Uptime,
+			SinceBoot: s.SinceBoot.clone(),
+			AllTime:   s.AllTime.clone(),
+		}
+		s.mutex.RUnlock()
+
+		return c.JSONPretty(http.StatusOK, snapshot, "\t")
+	}
+}
+
+// basicAuth checks the request against creds without leaking through
+// timing how much of either value matched.
+func basicAuth(creds AdminConfig) echo.MiddlewareFunc {
+	return middleware.BasicAuthWithConfig(middleware.BasicAuthConfig{
+		Realm: "admin",
+		Validator: func(user, password string, c echo.Context) (bool, error) {
+			userOK := subtle.ConstantTimeCompare([]byte(user), []byte(creds.User)) == 1
+			passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(creds.Password)) == 1
+			return userOK && passwordOK, nil
+		},
+	})
+}
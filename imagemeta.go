@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// imageMeta describes a photo. It comes from the photo's sidecar file,
+// lake.yaml next to lake.jpg, or from its entry in the images.yaml
+// manifest of the image directory. The sidecar wins where both set a
+// field.
+type imageMeta struct {
+	Caption  string   `yaml:"caption"`
+	Alt      string   `yaml:"alt"`
+	Date     string   `yaml:"date"`
+	Location string   `yaml:"location"`
+	Tags     []string `yaml:"tags"`
+	Weight   *float64 `yaml:"weight"`
+}
+
+const (
+	imageManifest = "images.yaml"
+	dateLayout    = "2006-01-02"
+)
+
+// loadImageManifest reads the manifest in root, keyed by the photo's path
+// relative to root. Having no manifest is fine.
+func loadImageManifest(root string) (map[string]imageMeta, error) {
+	manifest := map[string]imageMeta{}
+
+	data, err := ioutil.ReadFile(filepath.Join(root, imageManifest))
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return manifest, err
+	}
+
+	if err := yaml.UnmarshalStrict(data, &manifest); err != nil {
+		return map[string]imageMeta{}, err
+	}
+	return manifest, nil
+}
+
+// loadSidecar reads the metadata file next to the photo at path on top of
+// meta. Having no sidecar is fine.
+func loadSidecar(path string, meta imageMeta) (imageMeta, error) {
+	sidecar := strings.TrimSuffix(path, filepath.Ext(path)) + ".yaml"
+
+	data, err := ioutil.ReadFile(sidecar)
+	if os.IsNotExist(err) {
+		return meta, nil
+	}
+	if err != nil {
+		return meta, err
+	}
+
+	if err := yaml.UnmarshalStrict(data, &meta); err != nil {
+		return meta, fmt.Errorf("%v: %v", sidecar, err)
+	}
+	return meta, nil
+}
+
+// apply fills in info from meta. Fields meta leaves out keep what the
+// file name rule gave them.
+func (meta imageMeta) apply(info *ImgInfo) error {
+	// The layout ends the caption with its own period.
+	if caption := strings.TrimSuffix(meta.Caption, "."); caption != "" {
+		info.Caption = caption
+	}
+	info.Alt = info.Caption
+	if meta.Alt != "" {
+		info.Alt = meta.Alt
+	}
+	info.Location = meta.Location
+	info.Tags = meta.Tags
+
+	info.Weight = 1
+	if meta.Weight != nil {
+		if *meta.Weight < 0 {
+			return fmt.Errorf("weight can't be negative, got %v", *meta.Weight)
+		}
+		info.Weight = *meta.Weight
+	}
+
+	if meta.Date != "" {
+		date, err := time.Parse(dateLayout, meta.Date)
+		if err != nil {
+			return fmt.Errorf("date %q should look like %v", meta.Date, dateLayout)
+		}
+		info.Date = date
+	}
+
+	return nil
+}
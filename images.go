@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type (
+	// ImagesConfig controls the resized copies made of every photo.
+	ImagesConfig struct {
+		// Widths are the sizes, in pixels, to offer besides the full size.
+		// Widths larger than a photo are skipped.
+		Widths  []int `yaml:"widths"`
+		Quality int   `yaml:"quality"`
+		// Sizes is the sizes attribute sent along with srcset.
+		Sizes string `yaml:"sizes"`
+		// CacheDir keeps the resized files between runs, so photos are
+		// only processed again when they change.
+		CacheDir string `yaml:"cache_dir"`
+		// Rotation picks which photo each page shows.
+		Rotation Rotation `yaml:"rotation"`
+	}
+
+	// ImgVariant is one resized copy of a photo.
+	ImgVariant struct {
+		URL    string
+		Width  int
+		Height int
+	}
+
+	// imageFormat is how a variant is encoded.
+	imageFormat struct {
+		ext         string
+		contentType string
+	}
+)
+
+var (
+	formatJPEG = imageFormat{ext: ".jpg", contentType: "image/jpeg"}
+	formatPNG  = imageFormat{ext: ".png", contentType: "image/png"}
+)
+
+// processImage makes the variants of the photo in data, one per width that
+// fits plus the full size, and caches them under cacheDir. Every variant is
+// re-encoded from decoded pixels, so EXIF metadata, GPS position included,
+// never makes it into what we serve. When every variant is cached already
+// the photo isn't decoded at all. original is the full size copy in the
+// photo's own format, for its original URL.
+func processImage(data []byte, cfg ImagesConfig) (full image.Point, variants []variantData, original variantData, err error) {
+	sum := sha256.Sum256(data)
+	key := hex.EncodeToString(sum[:])[:16]
+
+	header, name, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return image.Point{}, nil, variantData{}, err
+	}
+	orientation := jpegOrientation(data)
+	full = image.Pt(header.Width, header.Height)
+	if orientation >= 5 {
+		full = image.Pt(header.Height, header.Width)
+	}
+
+	var img *image.RGBA
+	decode := func() error {
+		if img != nil {
+			return nil
+		}
+		decoded, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		img = orient(toRGBA(decoded), orientation)
+		return nil
+	}
+	cached := func(width int, format imageFormat) string {
+		return filepath.Join(cfg.CacheDir, fmt.Sprintf("%v-%v-q%v%v", key, width, cfg.Quality, format.ext))
+	}
+	encode := func(v *variantData) error {
+		if err := decode(); err != nil {
+			return err
+		}
+		var err error
+		if v.data, err = encodeImage(resize(img, v.width, v.height), v.format, cfg.Quality); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(cfg.CacheDir, 0755); err != nil {
+			return err
+		}
+		return ioutil.WriteFile(cached(v.width, v.format), v.data, 0644)
+	}
+
+	for _, width := range variantWidths(full.X, cfg.Widths) {
+		v := variantData{width: width, height: scaledHeight(full, width)}
+
+		for _, format := range []imageFormat{formatJPEG, formatPNG} {
+			if v.data, err = ioutil.ReadFile(cached(width, format)); err == nil {
+				v.format = format
+				break
+			}
+		}
+
+		if v.data == nil {
+			if err := decode(); err != nil {
+				return image.Point{}, nil, variantData{}, err
+			}
+			// A photo without transparency is far smaller as a JPEG, even
+			// if it was saved as a PNG.
+			v.format = formatPNG
+			if img.Opaque() {
+				v.format = formatJPEG
+			}
+			if err := encode(&v); err != nil {
+				return image.Point{}, nil, variantData{}, err
+			}
+		}
+
+		variants = append(variants, v)
+	}
+
+	original = variants[len(variants)-1]
+	if format := sourceFormat(name); original.format != format {
+		original.format = format
+		if original.data, err = ioutil.ReadFile(cached(original.width, format)); err != nil {
+			if err := encode(&original); err != nil {
+				return image.Point{}, nil, variantData{}, err
+			}
+		}
+	}
+
+	return full, variants, original, nil
+}
+
+// sourceFormat is the format a photo was saved in, going by the name
+// image.Decode gives it.
+func sourceFormat(name string) imageFormat {
+	if name == "png" {
+		return formatPNG
+	}
+	return formatJPEG
+}
+
+type variantData struct {
+	width, height int
+	data          []byte
+	format        imageFormat
+}
+
+// variantWidths are the configured widths narrower than the photo, then
+// the photo's own width.
+func variantWidths(full int, widths []int) []int {
+	var out []int
+	for _, w := range widths {
+		if w < full {
+			out = append(out, w)
+		}
+	}
+	return append(out, full)
+}
+
+func scaledHeight(full image.Point, width int) int {
+	h := (full.Y*width + full.X/2) / full.X
+	if h < 1 {
+		h = 1
+	}
+	return h
+}
+
+// variantRoute names a variant after its photo, so /img/lake.jpg at 640
+// pixels is /img/lake-640w.jpg.
+func variantRoute(route string, width int, format imageFormat) string {
+	ext := filepath.Ext(route)
+	return fmt.Sprintf("%v-%vw%v", strings.TrimSuffix(route, ext), width, format.ext)
+}
+
+// escapeURL percent-encodes a path, so file names with spaces or commas
+// don't break a srcset list.
+func escapeURL(path string) string {
+	return (&url.URL{Path: path}).EscapedPath()
+}
+
+// srcset lists variants as "url 640w, ...".
+func srcset(variants []ImgVariant) string {
+	parts := make([]string, len(variants))
+	for i, v := range variants {
+		parts[i] = fmt.Sprintf("%v %vw", v.URL, v.Width)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func encodeImage(img image.Image, format imageFormat, quality int) ([]byte, error) {
+	var buf bytes.Buffer
+	var err error
+	if format == formatJPEG {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	} else {
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, img)
+	}
+	return buf.Bytes(), err
+}
+
+func toRGBA(img image.Image) *image.RGBA {
+	if rgba, ok := img.(*image.RGBA); ok && rgba.Rect.Min == (image.Point{}) {
+		return rgba
+	}
+	b := img.Bounds()
+	rgba := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(rgba, rgba.Rect, img, b.Min, draw.Src)
+	return rgba
+}
+
+// resize scales src to width by height by averaging the box of source
+// pixels behind every destination pixel, which is what shrinking a photo
+// needs to stay sharp without aliasing.
+func resize(src *image.RGBA, width, height int) *image.RGBA {
+	sw, sh := src.Rect.Dx(), src.Rect.Dy()
+	if sw == width && sh == height {
+		return src
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0, y1 := y*sh/height, (y+1)*sh/height
+		if y1 == y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < width; x++ {
+			x0, x1 := x*sw/width, (x+1)*sw/width
+			if x1 == x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, b, a, n int
+			for sy := y0; sy < y1; sy++ {
+				row := src.Pix[sy*src.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					p := row[sx*4 : sx*4+4]
+					r += int(p[0])
+					g += int(p[1])
+					b += int(p[2])
+					a += int(p[3])
+					n++
+				}
+			}
+
+			d := dst.Pix[y*dst.Stride+x*4:]
+			d[0] = uint8(r / n)
+			d[1] = uint8(g / n)
+			d[2] = uint8(b / n)
+			d[3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// orient applies an EXIF orientation, 1 through 8, so the photo looks
+// right once the EXIF data that said how to turn it is gone.
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation < 2 || orientation > 8 {
+		return src
+	}
+
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	// Orientations 5 through 8 turn the photo on its side.
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dy*dst.Stride+dx*4:dy*dst.Stride+dx*4+4], src.Pix[y*src.Stride+x*4:y*src.Stride+x*4+4])
+		}
+	}
+	return dst
+}
+
+// jpegOrientation reads the orientation tag out of a JPEG's EXIF data. It
+// returns 1, meaning no change, for anything else.
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	for i := 2; i+4 <= len(data) && data[i] == 0xFF; {
+		marker := data[i+1]
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if marker == 0xDA || length < 2 || i+2+length > len(data) {
+			// Start of scan: the image data follows, no more metadata. A
+			// length too short to count itself, or running past the end,
+			// means the file is broken, and whatever follows can't be
+			// trusted either.
+			break
+		}
+
+		segment := data[i+4 : i+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		i += 2 + length
+	}
+	return 1
+}
+
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	offset := order.Uint32(tiff[4:])
+	if uint64(offset)+2 > uint64(len(tiff)) {
+		return 1
+	}
+	ifd := int(offset)
+	entries := int(order.Uint16(tiff[ifd:]))
+	for n := 0; n < entries; n++ {
+		entry := ifd + 2 + n*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			return int(order.Uint16(tiff[entry+8:]))
+		}
+	}
+	return 1
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func testJPEG(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 8, 4)), nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// afterSOF puts segment right after the frame header of a JPEG, where
+// image.DecodeConfig has stopped reading.
+func afterSOF(t *testing.T, data, segment []byte) []byte {
+	i := bytes.Index(data, []byte{0xFF, 0xC0})
+	if i < 0 {
+		t.Fatal("no SOF0 segment")
+	}
+	end := i + 2 + int(data[i+2])<<8 + int(data[i+3])
+	out := append([]byte{}, data[:end]...)
+	out = append(out, segment...)
+	return append(out, data[end:]...)
+}
+
+func TestJPEGOrientationTruncatedSegment(t *testing.T) {
+	for _, segment := range [][]byte{
+		{0xFF, 0xE1, 0x00, 0x00},
+		{0xFF, 0xE1, 0x00, 0x01},
+		{0xFF, 0xE1, 0xFF, 0xFF},
+	} {
+		data := afterSOF(t, testJPEG(t), segment)
+		if got := jpegOrientation(data); got != 1 {
+			t.Errorf("segment % X: orientation %v, want 1", segment, got)
+		}
+		if got := jpegOrientation(append([]byte{0xFF, 0xD8}, segment...)); got != 1 {
+			t.Errorf("segment % X alone: orientation %v, want 1", segment, got)
+		}
+	}
+}
+
+func TestProcessImageTruncatedSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := defaultConfig().Images
+	cfg.CacheDir = dir
+	data := afterSOF(t, testJPEG(t), []byte{0xFF, 0xE1, 0x00, 0x00})
+	// Decoding the pixels may fail on the broken segment; it just must not
+	// panic.
+	processImage(data, cfg)
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	// A little endian TIFF header with one IFD entry: orientation 6.
+	tiff := []byte{
+		'I', 'I', 42, 0, 8, 0, 0, 0,
+		1, 0,
+		0x12, 0x01, 3, 0, 1, 0, 0, 0, 6, 0, 0, 0,
+		0, 0, 0, 0,
+	}
+	exif := append([]byte("Exif\x00\x00"), tiff...)
+	app1 := append([]byte{0xFF, 0xE1, 0, byte(len(exif) + 2)}, exif...)
+	data := testJPEG(t)
+	data = append(append(append([]byte{}, data[:2]...), app1...), data[2:]...)
+
+	if got := jpegOrientation(data); got != 6 {
+		t.Errorf("orientation %v, want 6", got)
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// IPMode controls what Stats records about a visitor's address.
+type IPMode string
+
+const (
+	// IPRaw records the address as is.
+	IPRaw IPMode = "raw"
+	// IPTruncated records only the /24 of an IPv4 address or the /48 of an
+	// IPv6 address.
+	IPTruncated IPMode = "truncated"
+	// IPHashed records a salted hash of the address. The salt changes every
+	// day and is never written down, so hashes can't be linked across days.
+	IPHashed IPMode = "hashed"
+	// IPOff records nothing.
+	IPOff IPMode = "off"
+)
+
+type ipAnonymizer struct {
+	mode    IPMode
+	saltDay string
+	salt    []byte
+}
+
+func newIPAnonymizer(mode IPMode) (*ipAnonymizer, error) {
+	switch mode {
+	case IPRaw, IPTruncated, IPHashed, IPOff:
+		return &ipAnonymizer{mode: mode}, nil
+	}
+	return nil, fmt.Errorf("unknown ip mode %q, want one of raw, truncated, hashed or off", mode)
+}
+
+// Key returns what to record for ip, and false if nothing should be. The
+// caller must hold the Stats mutex.
+func (a *ipAnonymizer) Key(ip string, now time.Time) (string, bool) {
+	switch a.mode {
+	case IPRaw:
+		return ip, true
+	case IPTruncated:
+		return truncateIP(ip), true
+	case IPHashed:
+		return a.hash(ip, now), true
+	}
+	return "", false
+}
+
+func (a *ipAnonymizer) hash(ip string, now time.Time) string {
+	day := now.UTC().Format("2006-01-02")
+	if day != a.saltDay {
+		a.salt = make([]byte, 16)
+		if _, err := rand.Read(a.salt); err != nil {
+			panic(err)
+		}
+		a.saltDay = day
+	}
+
+	sum := sha256.Sum256(append(append([]byte{}, a.salt...), ip...))
+	return hex.EncodeToString(sum[:8])
+}
+
+func truncateIP(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "(invalid)"
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+	return (&net.IPNet{IP: parsed.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
+// incrCapped counts key in m while keeping at most max keys, using the
+// space-saving algorithm: once m is full, a new key replaces the smallest
+// count and inherits it. Heavy hitters keep accurate counts, and a scan
+// from many addresses can't grow the map.
+func incrCapped(m map[string]int, key string, max int) {
+	if _, ok := m[key]; ok || len(m) < max {
+		m[key]++
+		return
+	}
+
+	minKey, minCount := "", 0
+	for k, v := range m {
+		if minKey == "" || v < minCount || (v == minCount && k < minKey) {
+			minKey, minCount = k, v
+		}
+	}
+	delete(m, minKey)
+	m[key] = minCount + 1
+}
+
+// rekeyIPs passes the addresses in m through a, so counters saved under a
+// more revealing mode are cleaned up on load, then trims m to max keys.
+func rekeyIPs(m map[string]int, a *ipAnonymizer, max int, now time.Time) map[string]int {
+	out := map[string]int{}
+	for k, v := range m {
+		if net.ParseIP(k) != nil {
+			var ok bool
+			if k, ok = a.Key(k, now); !ok {
+				continue
+			}
+		}
+		out[k] += v
+	}
+
+	if len(out) > max {
+		for _, c := range top(out, len(out))[max:] {
+			delete(out, c.Key)
+		}
+	}
+	return out
+}
+
+// proxies are the addresses trusted to say who they forward requests for.
+type proxies []*net.IPNet
+
+// parseProxies reads addresses and CIDR ranges, like 127.0.0.1 or
+// 10.0.0.0/8.
+func parseProxies(list []string) (proxies, error) {
+	var p proxies
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an address or CIDR range", s)
+		}
+		p = append(p, network)
+	}
+	return p, nil
+}
+
+func (p proxies) trusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	for _, network := range p {
+		if ip != nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the address of the visitor behind r. X-Forwarded-For and
+// X-Real-IP are only believed when the connection comes from a trusted
+// proxy, since anyone else can send them. X-Forwarded-For is read from the
+// end, because a proxy adds to whatever the client sent, and the first
+// address that isn't a trusted proxy is the visitor.
+func (p proxies) clientIP(r *http.Request) string {
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		addr = r.RemoteAddr
+	}
+	if !p.trusted(addr) {
+		return addr
+	}
+
+	if forwarded := r.Header.Get(echo.HeaderXForwardedFor); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			addr = strings.TrimSpace(hops[i])
+			if !p.trusted(addr) {
+				break
+			}
+		}
+		return addr
+	}
+	if real := r.Header.Get(echo.HeaderXRealIP); real != "" {
+		return real
+	}
+	return addr
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	p, err := parseProxies([]string{"127.0.0.1", "::1", "10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name      string
+		remote    string
+		forwarded string
+		realIP    string
+		want      string
+	}{
+		{"direct", "203.0.113.7:5000", "", "", "203.0.113.7"},
+		{"direct forging X-Forwarded-For", "203.0.113.7:5000", "198.51.100.1", "", "203.0.113.7"},
+		{"direct forging X-Real-IP", "203.0.113.7:5000", "", "198.51.100.1", "203.0.113.7"},
+		{"through a proxy", "127.0.0.1:5000", "198.51.100.1", "", "198.51.100.1"},
+		{"through two proxies", "127.0.0.1:5000", "198.51.100.1, 10.1.2.3", "", "198.51.100.1"},
+		{"forged hop through a proxy", "127.0.0.1:5000", "192.0.2.9, 198.51.100.1", "", "198.51.100.1"},
+		{"X-Real-IP through a proxy", "[::1]:5000", "", "198.51.100.1", "198.51.100.1"},
+		{"proxy without headers", "127.0.0.1:5000", "", "", "127.0.0.1"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = test.remote
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		if test.realIP != "" {
+			r.Header.Set("X-Real-IP", test.realIP)
+		}
+		if got := p.clientIP(r); got != test.want {
+			t.Errorf("%v: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseProxiesRejectsGarbage(t *testing.T) {
+	if _, err := parseProxies([]string{"not an address"}); err == nil {
+		t.Error("want an error")
+	}
+}
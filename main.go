@@ -1,173 +1,357 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
-	"sync"
-	"text/template"
 	"time"
 
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
 )
 
-func NewStats() *Stats {
-	return &Stats{
-		Uptime:      time.Now().UTC(),
-		Statuses:    map[string]int{},
-		IPAddresses: map[string]int{},
-	}
-}
-
-// Process is the middleware function.
-func (s *Stats) Process(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(c echo.Context) error {
-		timeIn := time.Now().UTC()
-		if err := next(c); err != nil {
-			c.Error(err)
-		}
-		s.mutex.Lock()
-		defer s.mutex.Unlock()
-		s.RequestCount++
-		status := strconv.Itoa(c.Response().Status)
-		s.Statuses[status]++
-		s.IPAddresses[c.RealIP()]++
-
-		log(c, timeIn, time.Now().UTC())
-		return nil
-	}
-}
-
-func log(c echo.Context, timeIn time.Time, currentTime time.Time) {
-	fmt.Printf("%v | %v | %v | %v | %v | %v \n",
-		timeIn.Format(time.RFC3339),
-		c.RealIP(),
-		c.Response().Status,
-		c.Request().Method,
-		c.Request().URL.Path,
-		currentTime.Sub(timeIn).String(),
-	)
-}
-
 type (
-	Stats struct {
-		Uptime       time.Time      `json:"uptime_since"`
-		RequestCount uint64         `json:"request_count"`
-		Statuses     map[string]int `json:"statuses"`
-		IPAddresses  map[string]int `json:"requests_by_ip_address"`
-		mutex        sync.RWMutex
-	}
-
 	ImgInfo struct {
 		Path    string
 		Caption string
+		// Slug names the photo in its permalink, /photos/{slug}.
+		Slug string
+		// URL is where the full size photo is served.
+		URL string
+		// Width and Height are the full size, so the page can reserve
+		// space for the photo before it loads.
+		Width    int
+		Height   int
+		Variants []ImgVariant
+		Srcset   string
+		Sizes    string
+		// Alt describes the photo for screen readers. It defaults to the
+		// caption.
+		Alt      string
+		Date     time.Time
+		Location string
+		Tags     []string
+		// Weight is how often the photo comes up relative to the others
+		// under the weighted rotation.
+		Weight float64
 	}
 )
 
 func main() {
 	e := echo.New()
 
-	masterTemplate, _ = template.ParseFiles("assets/template.html")
+	args := os.Args[1:]
+	building := len(args) > 0 && args[0] == "build"
+	if building {
+		args = args[1:]
+	}
+
+	cfg, err := loadConfig(args)
+	if err == flag.ErrHelp {
+		os.Exit(exitOK)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitConfigError)
+	}
+
+	if cfg.localBaseURL() {
+		e.Logger.Printf("base_url is %v, so feeds, the sitemap and link previews point there", cfg.BaseURL)
+	}
+
+	if building && upToDate(cfg) {
+		e.Logger.Printf("nothing changed since the last build in %v", cfg.BuildDir)
+		os.Exit(exitOK)
+	}
+
+	s, report := loadSite(cfg)
+	if !report.OK() {
+		fmt.Fprintln(os.Stderr, report)
+	}
+	if !report.usable(cfg.AllowDegraded) {
+		fmt.Fprintln(os.Stderr, "refusing to start, set allow_degraded to start anyway when no problem is fatal")
+		os.Exit(exitAssetError)
+	}
+	if building {
+		if err := build(s, cfg, e.Logger.Printf); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(exitBuildError)
+		}
+		os.Exit(exitOK)
+	}
+	current.Store(s)
+
+	go watchSite(cfg, e.Logger.Printf)
+
+	stats, err := NewStats(newJSONFileStore(cfg.Stats.File), cfg.Stats.IPMode, cfg.Stats.MaxIPs, cfg.TrustedProxies)
+	if err != nil {
+		e.Logger.Fatal(err)
+	}
+	go stats.FlushEvery(cfg.Stats.FlushInterval, e.Logger.Printf)
+
+	setRoutes(e, cfg, stats)
 
-	setRoutes(e)
+	onShutdown("flush stats", func(ctx context.Context) error {
+		return stats.Flush()
+	})
+	onShutdown("sync logs", syncLogs)
 
-	e.Logger.Fatal(e.Start(":8000"))
+	listeners := []func() error{
+		func() error { return e.Start(cfg.Addr) },
+	}
+	if cfg.TLS.ACME {
+		listeners, err = setACME(e, cfg.TLS)
+		if err != nil {
+			e.Logger.Fatal(err)
+		}
+	}
+
+	os.Exit(serve(e, cfg.ShutdownTimeout, listeners...))
 }
 
-func serveFileWithCache(e *echo.Echo, pathToFile, route string) error {
+// serveFileWithCache caches the file at route, and under a fingerprinted
+// alias of route that is cached by browsers for good.
+func serveFileWithCache(s *site, pathToFile, route, class string) error {
+	info, err := os.Stat(pathToFile)
+	if err != nil {
+		return err
+	}
+
 	f, err := ioutil.ReadFile(pathToFile)
 	if err != nil {
 		return err
 	}
 
-	e.GET(route, func(c echo.Context) error {
-		return c.Blob(
-			http.StatusOK,
-			http.DetectContentType(f),
-			f,
-		)
-	})
+	s.addBlob(route, filepath.Ext(pathToFile), newBlob(f, s.contentType(pathToFile, f), info.ModTime(), s.cacheControl[class]))
 
 	return nil
 }
 
-func setRoutes(e *echo.Echo) {
-	s := NewStats()
+// addBlob caches b at route and at its fingerprinted alias.
+func (s *site) addBlob(route, ext string, b blob) {
+	s.blobs[route] = b
 
+	fingerprinted := fingerprintedRoute(route, ext, b.hash)
+	b.cacheControl = s.cacheControl[classFingerprinted]
+	s.blobs[fingerprinted] = b
+	s.fingerprints[route] = fingerprinted
+}
+
+// serveBlob answers from the cache of the current site, so files that
+// appear or change on reload are served without registering new routes.
+func serveBlob(c echo.Context) error {
+	b, ok := currentSite().blobs[c.Request().URL.Path]
+	if !ok {
+		return echo.ErrNotFound
+	}
+
+	return writeBlob(c, b)
+}
+
+func setRoutes(e *echo.Echo, cfg Config, s *Stats) {
+	e.HTTPErrorHandler = httpErrorHandler(e.Logger.Printf)
 	e.Use(s.Process)
 	e.Use(middleware.Recover())
+	e.Use(middleware.SecureWithConfig(middleware.SecureConfig{
+		ContentTypeNosniff: "nosniff",
+	}))
+	if cfg.TLS.ACME && cfg.TLS.HSTSMaxAge > 0 {
+		e.Use(hsts(cfg.TLS))
+	}
+
+	e.GET("/healthz", serveHealth(s))
+
+	if cfg.Admin.User != "" {
+		g := e.Group("/admin", basicAuth(cfg.Admin))
+		g.GET("/stats", serveAdminStats(s))
+		g.GET("/health", serveAdminHealth(s))
+		g.GET("/traffic", s.serveDashboard)
+		g.GET("/traffic.json", s.serveDashboardJSON)
+	} else {
+		e.Logger.Printf("no admin credentials configured, /admin is disabled")
+	}
+
+	setSiteRoutes(e, cfg)
+}
 
-	e.GET("/healthz", func(c echo.Context) error {
-		return c.JSONPretty(http.StatusOK, s, "\t")
+// setSiteRoutes registers the routes that only depend on the loaded site,
+// which are also the ones build renders.
+func setSiteRoutes(e *echo.Echo, cfg Config) {
+	e.GET("/", func(c echo.Context) error {
+		return c.Redirect(http.StatusFound, cfg.Home)
 	})
+	for from, to := range cfg.Redirects {
+		to := to
+		e.GET(from, func(c echo.Context) error {
+			return c.Redirect(http.StatusMovedPermanently, to)
+		})
+	}
 
-	serveFileWithCache(e, "assets/style.css", "/style")
-	serveFileWithCache(e, "assets/mannes_resume.pdf", "/resume")
+	e.GET("/posts", servePosts(cfg.PostsPerPage))
+	e.GET("/posts/:slug", servePost)
+	e.GET("/tags/:tag", serveTag)
+	e.GET("/archive/:year", serveYear)
 
-	setIcons(e)
-	setImg(e)
+	e.GET("/photos", servePhotos)
+	e.GET("/photos/:slug", servePhoto)
 
-	e.GET("/*", Route)
+	for route := range cfg.Files {
+		getOrHead(e, route, serveBlob)
+	}
+	getOrHead(e, cfg.ImageRoute+"/*", serveBlob)
+	for route := range feeds {
+		getOrHead(e, route, serveBlob)
+	}
+	getOrHead(e, "/sitemap.xml", serveBlob)
+	getOrHead(e, "/robots.txt", serveBlob)
 
+	getOrHead(e, "/favicon.ico", func(c echo.Context) error {
+		icons := currentSite().icons
+		if len(icons) == 0 {
+			return echo.ErrNotFound
+		}
+		return writeBlob(c, icons[rand.Intn(len(icons))])
+	})
+
+	// Fingerprinted assets are served from here too.
+	getOrHead(e, "/*", Route)
 }
 
-func setIcons(e *echo.Echo) error {
+// getOrHead routes GET and HEAD to h. Download managers and PDF viewers
+// send HEAD to learn the size and whether ranges work before asking for
+// any; writeBlob sets those headers either way and net/http leaves out
+// the body.
+func getOrHead(e *echo.Echo, route string, h echo.HandlerFunc) {
+	e.GET(route, h)
+	e.HEAD(route, h)
+}
 
-	mFile, err := ioutil.ReadFile("assets/m.png")
-	if err != nil {
-		return err
+func setIcons(s *site, files []string, report *LoadReport) {
+
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			report.add("favicon", file, err, false)
+			continue
+		}
+
+		f, err := ioutil.ReadFile(file)
+		if err != nil {
+			report.add("favicon", file, err, false)
+			continue
+		}
+
+		s.icons = append(s.icons, newBlob(f, s.contentType(file, f), info.ModTime(), s.cacheControl[classIcon]))
 	}
+}
 
-	nFile, err := ioutil.ReadFile("assets/n.png")
+// setImg caches resized copies of every photo under root. Photos that
+// can't be read are left out of the rotation; having none at all is fatal,
+// since every page shows one.
+func setImg(s *site, root, route string, cfg ImagesConfig, report *LoadReport) {
+	manifest, err := loadImageManifest(root)
 	if err != nil {
-		return err
+		report.add("image", filepath.Join(root, imageManifest), err, false)
 	}
+	described := map[string]bool{}
+	slugs := map[string]bool{}
 
-	e.GET("/favicon.ico", func(c echo.Context) error {
-		fileReturn := mFile
-		if rand.Intn(2) == 0 {
-			fileReturn = nFile
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			report.add("image", path, err, false)
+			return nil
 		}
 
-		return c.Blob(
-			http.StatusOK,
-			http.DetectContentType(fileReturn),
-			fileReturn,
-		)
-	})
-
-	return nil
-}
-
-func setImg(e *echo.Echo) error {
-	root := "assets/img"
-	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
 		if strings.Contains(info.Name(), ".jpg") ||
 			strings.Contains(info.Name(), ".png") {
 
-			sections := strings.Split(path, "/")
-			fileName := strings.Split(sections[2], ".")
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				report.add("image", path, err, false)
+				return nil
+			}
+			url := route + "/" + filepath.ToSlash(rel)
+
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				report.add("image", path, err, false)
+				return nil
+			}
+
+			full, variants, original, err := processImage(data, cfg)
+			if err != nil {
+				report.add("image", path, err, false)
+				return nil
+			}
+
+			fileName := strings.Split(info.Name(), ".")
 			imageInfo := ImgInfo{
-				Path:    fmt.Sprintf("\"%v\"", path),
 				Caption: strings.ReplaceAll(fileName[0], "_", " "),
+				Width:   full.X,
+				Height:  full.Y,
+				Sizes:   cfg.Sizes,
+				Slug:    slugify(fileName[0]),
 			}
-			images = append(images, imageInfo)
+			// lake.jpg and lake.png would share a permalink otherwise.
+			for n := 2; slugs[imageInfo.Slug]; n++ {
+				imageInfo.Slug = fmt.Sprintf("%v-%v", slugify(fileName[0]), n)
+			}
+			slugs[imageInfo.Slug] = true
+
+			// A photo with broken metadata is still shown, with whatever
+			// the file name rule gives it.
+			key := filepath.ToSlash(rel)
+			described[key] = true
+			meta, err := loadSidecar(path, manifest[key])
+			if err == nil {
+				err = meta.apply(&imageInfo)
+			}
+			if err != nil {
+				report.add("image", path, err, false)
+				imageMeta{}.apply(&imageInfo)
+			}
+
+			src := ""
+			for _, v := range variants {
+				variantURL := variantRoute(url, v.width, v.format)
+				s.addBlob(variantURL, v.format.ext, newBlob(v.data, v.format.contentType, info.ModTime(), s.cacheControl[classImage]))
+
+				imageInfo.Variants = append(imageInfo.Variants, ImgVariant{
+					URL:    escapeURL(s.assetURL(variantURL)),
+					Width:  v.width,
+					Height: v.height,
+				})
+				if src == "" || v.width <= cfg.Widths[len(cfg.Widths)-1] {
+					src = imageInfo.Variants[len(imageInfo.Variants)-1].URL
+				}
+			}
+			imageInfo.Path = src
+			imageInfo.URL = escapeURL(url)
+			imageInfo.Srcset = srcset(imageInfo.Variants)
+
+			// The original URL keeps working, and keeps its format, but
+			// serves the full size copy with its metadata stripped.
+			s.blobs[url] = newBlob(original.data, original.format.contentType, info.ModTime(), s.cacheControl[classImage])
 
-			serveFileWithCache(e, path, path)
+			s.images = append(s.images, imageInfo)
 
 		}
 		return nil
 	})
 
-	if err != nil {
-		return err
+	for key := range manifest {
+		if !described[key] {
+			report.add("image", filepath.Join(root, imageManifest), fmt.Errorf("%v is not a photo in %v", key, root), false)
+		}
 	}
 
-	return nil
+	if len(s.images) == 0 {
+		report.add("image", root, fmt.Errorf("no photos found"), true)
+	}
 }
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// mimeTypes are the types we know by extension. They don't depend on the
+// machine's mime.types, which differs between hosts and misses things like
+// .webp on older systems.
+var mimeTypes = map[string]string{
+	".css":   "text/css; charset=utf-8",
+	".html":  "text/html; charset=utf-8",
+	".js":    "text/javascript; charset=utf-8",
+	".json":  "application/json",
+	".txt":   "text/plain; charset=utf-8",
+	".xml":   "application/xml",
+	".svg":   "image/svg+xml",
+	".png":   "image/png",
+	".jpg":   "image/jpeg",
+	".jpeg":  "image/jpeg",
+	".gif":   "image/gif",
+	".webp":  "image/webp",
+	".ico":   "image/x-icon",
+	".pdf":   "application/pdf",
+	".woff2": "font/woff2",
+}
+
+// contentType resolves the type of a file from its extension, first in the
+// configured overrides, then in mimeTypes, then in the system table. Only a
+// file with an unknown extension is sniffed.
+func (s *site) contentType(path string, data []byte) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext != "" {
+		if t, ok := s.mimeOverrides[ext]; ok {
+			return t
+		}
+		if t, ok := mimeTypes[ext]; ok {
+			return t
+		}
+		if t := mime.TypeByExtension(ext); t != "" {
+			return t
+		}
+	}
+	return http.DetectContentType(data)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+type (
+	// Post is one file of the posts directory, published at /posts/{slug}
+	// where the slug is its file name.
+	Post struct {
+		Slug  string
+		Title string
+		Date  time.Time
+		// Updated is when the post last changed enough to tell feed
+		// readers. It defaults to Date.
+		Updated time.Time
+		Tags    []string
+		Summary string
+		// Body holds the post's paragraphs.
+		Body []template.HTML
+	}
+
+	// postFrontMatter is the YAML header at the top of every post.
+	postFrontMatter struct {
+		Title   string   `yaml:"title"`
+		Date    string   `yaml:"date"`
+		Updated string   `yaml:"updated"`
+		Tags    []string `yaml:"tags"`
+		Summary string   `yaml:"summary"`
+		// Draft posts are left out of the site until this is unset.
+		Draft bool `yaml:"draft"`
+		// HTML marks the body as trusted HTML.
+		HTML bool `yaml:"html"`
+	}
+
+	// postsPage is the data for the posts view, which lists posts under a
+	// heading.
+	postsPage struct {
+		ImgInfo
+		Heading string
+		Posts   []Post
+		Years   []int
+		// Newer and Older link to the pages around this one of the index.
+		Newer, Older string
+		Meta         Meta
+	}
+
+	// postPage is the data for the post view.
+	postPage struct {
+		ImgInfo
+		Post Post
+		Meta Meta
+	}
+)
+
+// loadPosts reads every post in dir, newest first. Having no posts
+// directory is fine. A post that can't be loaded is a fatal problem, like
+// a page.
+func loadPosts(dir string, report *LoadReport) []Post {
+	var posts []Post
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.md"))
+	if err != nil {
+		report.add("post", dir, err, true)
+		return posts
+	}
+
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			report.add("post", file, err, true)
+			continue
+		}
+
+		slug := strings.TrimSuffix(filepath.Base(file), ".md")
+		if slugify(slug) != slug {
+			report.add("post", file, fmt.Errorf("the file name is its URL, rename it to %v.md", slugify(slug)), true)
+			continue
+		}
+
+		post, draft, err := parsePost(slug, data)
+		if err != nil {
+			report.add("post", file, err, true)
+			continue
+		}
+		if !draft {
+			posts = append(posts, post)
+		}
+	}
+
+	sort.Slice(posts, func(i, j int) bool {
+		if !posts[i].Date.Equal(posts[j].Date) {
+			return posts[i].Date.After(posts[j].Date)
+		}
+		return posts[i].Slug < posts[j].Slug
+	})
+	return posts
+}
+
+// parsePost splits a post into its front matter and body. Paragraphs of the
+// body are separated by blank lines. It also reports whether the post is a
+// draft.
+func parsePost(slug string, data []byte) (Post, bool, error) {
+	var fm postFrontMatter
+	body, err := splitFrontMatter(data, &fm)
+	if err != nil {
+		return Post{}, false, err
+	}
+
+	if fm.Title == "" {
+		return Post{}, false, fmt.Errorf("missing title")
+	}
+	date, err := time.Parse(dateLayout, fm.Date)
+	if err != nil {
+		return Post{}, false, fmt.Errorf("date %q should look like %v", fm.Date, dateLayout)
+	}
+
+	post := Post{
+		Slug:    slug,
+		Title:   fm.Title,
+		Date:    date,
+		Updated: date,
+		Summary: fm.Summary,
+	}
+	if fm.Updated != "" {
+		post.Updated, err = time.Parse(dateLayout, fm.Updated)
+		if err != nil || post.Updated.Before(date) {
+			return Post{}, false, fmt.Errorf("updated %q should look like %v and not be before the date", fm.Updated, dateLayout)
+		}
+	}
+	for _, tag := range fm.Tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if slugify(tag) != tag {
+			return Post{}, false, fmt.Errorf("tag %q can only use letters, digits and dashes", tag)
+		}
+		post.Tags = append(post.Tags, tag)
+	}
+
+	var paragraph []string
+	for _, line := range strings.Split(body+"\n", "\n") {
+		if trimmed := strings.TrimSpace(line); trimmed != "" {
+			paragraph = append(paragraph, trimmed)
+			continue
+		}
+		if len(paragraph) > 0 {
+			post.Body = append(post.Body, trust(fm.HTML, strings.Join(paragraph, " ")))
+			paragraph = nil
+		}
+	}
+
+	return post, fm.Draft, nil
+}
+
+// years lists the years posts were written in, newest first.
+func years(posts []Post) []int {
+	var years []int
+	for _, post := range posts {
+		if year := post.Date.Year(); len(years) == 0 || years[len(years)-1] != year {
+			years = append(years, year)
+		}
+	}
+	return years
+}
+
+// servePosts lists every post, perPage at a time. Later pages are at
+// /posts?page=2 and so on.
+func servePosts(perPage int) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		s := currentSite()
+
+		page := 1
+		if p := c.QueryParam("page"); p != "" {
+			var err error
+			page, err = strconv.Atoi(p)
+			if err != nil || page < 1 {
+				return echo.ErrNotFound
+			}
+		}
+
+		start := (page - 1) * perPage
+		if start > 0 && start >= len(s.posts) {
+			return echo.ErrNotFound
+		}
+		end := start + perPage
+		if end > len(s.posts) {
+			end = len(s.posts)
+		}
+
+		data := postsPage{
+			ImgInfo: s.photo(c),
+			Heading: "Posts",
+			Posts:   s.posts[start:end],
+			Years:   years(s.posts),
+			Meta:    s.meta(c, "Posts", "Writing by "+s.person.Name+"."),
+		}
+		if page > 1 {
+			data.Meta.URL += fmt.Sprintf("?page=%v", page)
+		}
+		if page == 2 {
+			data.Newer = "/posts"
+		} else if page > 2 {
+			data.Newer = fmt.Sprintf("/posts?page=%v", page-1)
+		}
+		if end < len(s.posts) {
+			data.Older = fmt.Sprintf("/posts?page=%v", page+1)
+		}
+
+		return s.writeView(c, http.StatusOK, "posts", data)
+	}
+}
+
+func servePost(c echo.Context) error {
+	s := currentSite()
+	for _, post := range s.posts {
+		if post.Slug == c.Param("slug") {
+			meta := s.meta(c, post.Title, post.Summary)
+			meta.Type = "article"
+			return s.writeView(c, http.StatusOK, "post", postPage{
+				ImgInfo: s.photo(c),
+				Post:    post,
+				Meta:    meta,
+			})
+		}
+	}
+	return echo.ErrNotFound
+}
+
+func serveTag(c echo.Context) error {
+	s := currentSite()
+	tag := c.Param("tag")
+
+	var tagged []Post
+	for _, post := range s.posts {
+		for _, t := range post.Tags {
+			if t == tag {
+				tagged = append(tagged, post)
+				break
+			}
+		}
+	}
+	if len(tagged) == 0 {
+		return echo.ErrNotFound
+	}
+
+	return s.writeView(c, http.StatusOK, "posts", postsPage{
+		ImgInfo: s.photo(c),
+		Heading: "Posts tagged " + tag,
+		Posts:   tagged,
+		Meta:    s.meta(c, "Posts tagged "+tag, ""),
+	})
+}
+
+func serveYear(c echo.Context) error {
+	s := currentSite()
+	year, err := strconv.Atoi(c.Param("year"))
+	if err != nil {
+		return echo.ErrNotFound
+	}
+
+	var written []Post
+	for _, post := range s.posts {
+		if post.Date.Year() == year {
+			written = append(written, post)
+		}
+	}
+	if len(written) == 0 {
+		return echo.ErrNotFound
+	}
+
+	return s.writeView(c, http.StatusOK, "posts", postsPage{
+		ImgInfo: s.photo(c),
+		Heading: fmt.Sprintf("Posts from %v", year),
+		Posts:   written,
+		Years:   years(s.posts),
+		Meta:    s.meta(c, fmt.Sprintf("Posts from %v", year), ""),
+	})
+}
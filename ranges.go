@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+type byteRange struct {
+	start, length int64
+}
+
+// maxRanges caps how many ranges one request may ask for. Anything beyond
+// it gets the whole file, so a request for thousands of tiny ranges can't
+// make us build a huge multipart response.
+const maxRanges = 16
+
+var errUnsatisfiable = errors.New("no satisfiable range")
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange parses a Range header against a body of size bytes. A header
+// we can't parse returns nil ranges and no error, since RFC 7233 says to
+// ignore it and send the whole body.
+func parseRange(header string, size int64) ([]byteRange, error) {
+	if !strings.HasPrefix(header, "bytes=") {
+		return nil, nil
+	}
+
+	var ranges []byteRange
+	for _, spec := range strings.Split(header[len("bytes="):], ",") {
+		spec = strings.TrimSpace(spec)
+		dash := strings.Index(spec, "-")
+		if dash < 0 {
+			return nil, nil
+		}
+		first, last := spec[:dash], spec[dash+1:]
+
+		var r byteRange
+		if first == "" {
+			// A suffix range: the last n bytes.
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, nil
+			}
+			if n == 0 {
+				continue
+			}
+			if n > size {
+				n = size
+			}
+			r = byteRange{start: size - n, length: n}
+		} else {
+			start, err := strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return nil, nil
+			}
+			end := size - 1
+			if last != "" {
+				if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+					return nil, nil
+				}
+				if end >= size {
+					end = size - 1
+				}
+			}
+			if start >= size {
+				continue
+			}
+			r = byteRange{start: start, length: end - start + 1}
+		}
+		ranges = append(ranges, r)
+	}
+
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiable
+	}
+	if len(ranges) > maxRanges {
+		return nil, nil
+	}
+	return ranges, nil
+}
+
+// ifRangeMatches reports whether the client's copy, named by If-Range, is
+// still current. Only a strong comparison counts, so any change to the
+// body means the client gets the whole thing again.
+func ifRangeMatches(r *http.Request, etag string, modTime time.Time) bool {
+	ir := r.Header.Get("If-Range")
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, `"`) {
+		return ir == etag
+	}
+	t, err := http.ParseTime(ir)
+	return err == nil && t.Equal(modTime)
+}
+
+// writeRanges answers a Range request for data with 206 Partial Content,
+// or 416 when none of the ranges overlap it. It returns false when the
+// request should get the whole body instead.
+func writeRanges(c echo.Context, data []byte, contentType, etag string, modTime time.Time) (bool, error) {
+	req := c.Request()
+	header := req.Header.Get("Range")
+	if header == "" || !ifRangeMatches(req, etag, modTime) {
+		return false, nil
+	}
+
+	size := int64(len(data))
+	ranges, err := parseRange(header, size)
+	h := c.Response().Header()
+	if err == errUnsatisfiable {
+		h.Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		return true, c.NoContent(http.StatusRequestedRangeNotSatisfiable)
+	}
+	if ranges == nil {
+		return false, nil
+	}
+
+	if len(ranges) == 1 {
+		r := ranges[0]
+		h.Set("Content-Range", r.contentRange(size))
+		h.Set("Content-Length", strconv.FormatInt(r.length, 10))
+		return true, c.Blob(http.StatusPartialContent, contentType, data[r.start:r.start+r.length])
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for _, r := range ranges {
+		part, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":  {contentType},
+			"Content-Range": {r.contentRange(size)},
+		})
+		if err != nil {
+			return true, err
+		}
+		if _, err := part.Write(data[r.start : r.start+r.length]); err != nil {
+			return true, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return true, err
+	}
+
+	h.Set("Content-Length", strconv.Itoa(body.Len()))
+	return true, c.Blob(http.StatusPartialContent, "multipart/byteranges; boundary="+mw.Boundary(), body.Bytes())
+}
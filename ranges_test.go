@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRange(t *testing.T) {
+	tooMany := make([]string, maxRanges+1)
+	var most []byteRange
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("%v-%v", i*10, i*10+1)
+		if i < maxRanges {
+			most = append(most, byteRange{int64(i * 10), 2})
+		}
+	}
+
+	for _, test := range []struct {
+		header string
+		want   []byteRange
+		err    error
+	}{
+		{"bytes=0-99", []byteRange{{0, 100}}, nil},
+		{"bytes=999-999", []byteRange{{999, 1}}, nil},
+		// Suffixes are the last n bytes, all of them if n is too big.
+		{"bytes=-100", []byteRange{{900, 100}}, nil},
+		{"bytes=-2000", []byteRange{{0, 1000}}, nil},
+		// Open ended, or running past the end, stops at the end.
+		{"bytes=900-", []byteRange{{900, 100}}, nil},
+		{"bytes=990-2000", []byteRange{{990, 10}}, nil},
+		// Several ranges, overlapping or not, are kept as asked.
+		{"bytes=0-0, -1", []byteRange{{0, 1}, {999, 1}}, nil},
+		{"bytes=0-99,50-149", []byteRange{{0, 100}, {50, 100}}, nil},
+		{"bytes=0-1,2000-", []byteRange{{0, 2}}, nil},
+		// Too many ranges get the whole body.
+		{"bytes=" + strings.Join(tooMany, ","), nil, nil},
+		{"bytes=" + strings.Join(tooMany[:maxRanges], ","), most, nil},
+		// Nothing that overlaps the body.
+		{"bytes=1000-", nil, errUnsatisfiable},
+		{"bytes=-0", nil, errUnsatisfiable},
+		{"bytes=1000-1100,2000-", nil, errUnsatisfiable},
+		// Headers we don't understand are ignored.
+		{"items=0-1", nil, nil},
+		{"bytes=abc", nil, nil},
+		{"bytes=5-1", nil, nil},
+		{"bytes=-x", nil, nil},
+		{"bytes=1-2,x-", nil, nil},
+	} {
+		got, err := parseRange(test.header, 1000)
+		if err != test.err {
+			t.Errorf("%.40v: error %v, want %v", test.header, err, test.err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%.40v: got %v, want %v", test.header, got, test.want)
+		}
+	}
+}
+
+func TestIfRangeMatches(t *testing.T) {
+	etag := `"abc123"`
+	modTime := time.Date(2020, 6, 8, 12, 0, 0, 0, time.UTC)
+
+	for _, test := range []struct {
+		ifRange string
+		want    bool
+	}{
+		{"", true},
+		{`"abc123"`, true},
+		{`"other"`, false},
+		// If-Range only takes strong comparisons.
+		{`W/"abc123"`, false},
+		{modTime.Format(http.TimeFormat), true},
+		{modTime.Add(time.Second).Format(http.TimeFormat), false},
+		{modTime.Add(-time.Second).Format(http.TimeFormat), false},
+		{"yesterday", false},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/resume", nil)
+		if test.ifRange != "" {
+			r.Header.Set("If-Range", test.ifRange)
+		}
+		if got := ifRangeMatches(r, etag, modTime); got != test.want {
+			t.Errorf("If-Range %q: got %v, want %v", test.ifRange, got, test.want)
+		}
+	}
+}
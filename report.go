@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+type (
+	// LoadReport collects every problem found while loading the site, so
+	// they can all be fixed in one go instead of one restart at a time.
+	LoadReport struct {
+		Problems []LoadProblem `json:"problems"`
+	}
+
+	// LoadProblem is one file that could not be loaded. A fatal problem
+	// means pages can't be rendered at all; anything else only takes one
+	// asset offline.
+	LoadProblem struct {
+		Kind  string `json:"kind"`
+		Path  string `json:"path"`
+		Error string `json:"error"`
+		Fatal bool   `json:"fatal"`
+	}
+)
+
+func (r *LoadReport) add(kind, path string, err error, fatal bool) {
+	r.Problems = append(r.Problems, LoadProblem{
+		Kind:  kind,
+		Path:  path,
+		Error: err.Error(),
+		Fatal: fatal,
+	})
+}
+
+func (r LoadReport) Fatal() bool {
+	for _, p := range r.Problems {
+		if p.Fatal {
+			return true
+		}
+	}
+	return false
+}
+
+func (r LoadReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// usable reports whether a site with this report may be served.
+func (r LoadReport) usable(allowDegraded bool) bool {
+	return r.OK() || (allowDegraded && !r.Fatal())
+}
+
+func (r LoadReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "found %v problem(s) loading the site:", len(r.Problems))
+	for _, p := range r.Problems {
+		severity := "degraded"
+		if p.Fatal {
+			severity = "fatal"
+		}
+		fmt.Fprintf(&b, "\n\t%-8v %-8v %v: %v", severity, p.Kind, p.Path, p.Error)
+	}
+	return b.String()
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Rotation controls which photo a page shows.
+type Rotation string
+
+const (
+	// RotationShuffle deals the photos out like a deck of cards, so every
+	// photo is shown once before any is shown again.
+	RotationShuffle Rotation = "shuffle"
+	// RotationVisitor picks at random, but never the photo the visitor saw
+	// last. It remembers that photo in a cookie.
+	RotationVisitor Rotation = "visitor"
+	// RotationWeighted picks at random, favoring photos by their weight.
+	RotationWeighted Rotation = "weighted"
+	// RotationDaily shows everyone the same photo all day.
+	RotationDaily Rotation = "daily"
+	// RotationPage always shows the same photo on the same page. build
+	// uses it so rebuilding an unchanged site changes nothing.
+	RotationPage Rotation = "page"
+)
+
+const photoCookie = "photo"
+
+// rotator picks the photo for a request out of photos. photos is never
+// empty.
+type rotator interface {
+	Next(c echo.Context, photos []ImgInfo) ImgInfo
+}
+
+// newRotator returns the rotator for mode. Everything random comes from
+// rng and the date from now, so a caller can make the choices repeatable.
+func newRotator(mode Rotation, rng *rand.Rand, now func() time.Time) (rotator, error) {
+	switch mode {
+	case RotationShuffle:
+		return &shuffleBag{rng: rng}, nil
+	case RotationVisitor:
+		return &visitorRotation{rng: rng}, nil
+	case RotationWeighted:
+		return &weightedRotation{rng: rng}, nil
+	case RotationDaily:
+		return dailyRotation{now: now}, nil
+	case RotationPage:
+		return pageRotation{}, nil
+	}
+	return nil, fmt.Errorf("unknown rotation %q, want one of shuffle, visitor, weighted, daily or page", mode)
+}
+
+type shuffleBag struct {
+	rng   *rand.Rand
+	mutex sync.Mutex
+	// bag holds the slugs not dealt yet this round. Slugs rather than
+	// indexes, so a round carries on across a reload that adds or removes
+	// photos.
+	bag  []string
+	last string
+}
+
+func (b *shuffleBag) Next(c echo.Context, photos []ImgInfo) ImgInfo {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	index := slugIndex(photos)
+	for {
+		if len(b.bag) == 0 {
+			b.bag = make([]string, len(photos))
+			for i, j := range b.rng.Perm(len(photos)) {
+				b.bag[i] = photos[j].Slug
+			}
+			// Don't start a round with the photo that ended the last one.
+			if len(b.bag) > 1 && b.bag[len(b.bag)-1] == b.last {
+				b.bag[0], b.bag[len(b.bag)-1] = b.bag[len(b.bag)-1], b.bag[0]
+			}
+		}
+
+		slug := b.bag[len(b.bag)-1]
+		b.bag = b.bag[:len(b.bag)-1]
+		// Photos removed since the round started are skipped.
+		if i, ok := index[slug]; ok {
+			b.last = slug
+			return photos[i]
+		}
+	}
+}
+
+type visitorRotation struct {
+	rng   *rand.Rand
+	mutex sync.Mutex
+}
+
+func (v *visitorRotation) Next(c echo.Context, photos []ImgInfo) ImgInfo {
+	last := -1
+	if cookie, err := c.Cookie(photoCookie); err == nil {
+		// Slugs keep non-ASCII letters, which a cookie can't hold as is.
+		slug, _ := url.QueryUnescape(cookie.Value)
+		if i, ok := slugIndex(photos)[slug]; ok {
+			last = i
+		}
+	}
+
+	v.mutex.Lock()
+	var i int
+	if last < 0 || len(photos) == 1 {
+		i = v.rng.Intn(len(photos))
+	} else {
+		// Pick among the others by skipping over last.
+		i = v.rng.Intn(len(photos) - 1)
+		if i >= last {
+			i++
+		}
+	}
+	v.mutex.Unlock()
+
+	c.SetCookie(&http.Cookie{
+		Name:     photoCookie,
+		Value:    url.QueryEscape(photos[i].Slug),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return photos[i]
+}
+
+func slugIndex(photos []ImgInfo) map[string]int {
+	index := make(map[string]int, len(photos))
+	for i, photo := range photos {
+		index[photo.Slug] = i
+	}
+	return index
+}
+
+type weightedRotation struct {
+	rng   *rand.Rand
+	mutex sync.Mutex
+}
+
+// Next picks photos in proportion to their weight. Photos with no weight
+// are never picked, unless no photo has any.
+func (w *weightedRotation) Next(c echo.Context, photos []ImgInfo) ImgInfo {
+	total := 0.0
+	for _, photo := range photos {
+		total += photo.Weight
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if total <= 0 {
+		return photos[w.rng.Intn(len(photos))]
+	}
+
+	pick := w.rng.Float64() * total
+	for _, photo := range photos {
+		if pick < photo.Weight {
+			return photo
+		}
+		pick -= photo.Weight
+	}
+	// Rounding can leave pick just short of the end.
+	for i := len(photos) - 1; ; i-- {
+		if photos[i].Weight > 0 {
+			return photos[i]
+		}
+	}
+}
+
+type dailyRotation struct {
+	now func() time.Time
+}
+
+// Next shows the photos in an order shuffled once per len(photos) days, so
+// no photo comes back until the others have all had their day.
+func (d dailyRotation) Next(c echo.Context, photos []ImgInfo) ImgInfo {
+	year, month, day := d.now().Date()
+	days := time.Date(year, month, day, 0, 0, 0, 0, time.UTC).Unix() / (24 * 60 * 60)
+
+	n := int64(len(photos))
+	return photos[dailyOrder(days/n, len(photos))[days%n]]
+}
+
+// dailyOrder is the order of the n photos in round. Like the shuffle bag,
+// a round never starts with the photo that ended the round before; the
+// swap leaves the last photo alone, so the round before doesn't need
+// fixing up in turn.
+func dailyOrder(round int64, n int) []int {
+	if n <= 2 {
+		// One photo can't change and two can only take turns.
+		order := make([]int, n)
+		for i := range order {
+			order[i] = i
+		}
+		return order
+	}
+
+	order := rand.New(rand.NewSource(round)).Perm(n)
+	last := rand.New(rand.NewSource(round - 1)).Perm(n)[n-1]
+	if order[0] == last {
+		order[0], order[1] = order[1], order[0]
+	}
+	return order
+}
+
+type pageRotation struct{}
+
+func (pageRotation) Next(c echo.Context, photos []ImgInfo) ImgInfo {
+	h := fnv.New32a()
+	h.Write([]byte(c.Request().URL.Path))
+	return photos[h.Sum32()%uint32(len(photos))]
+}
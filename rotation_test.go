@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+var testNow = time.Date(2020, 6, 8, 12, 0, 0, 0, time.UTC)
+
+func testPhotos(weights ...float64) []ImgInfo {
+	photos := make([]ImgInfo, len(weights))
+	for i, weight := range weights {
+		photos[i] = ImgInfo{Slug: fmt.Sprintf("photo-%v", i), Weight: weight}
+	}
+	return photos
+}
+
+func testRotator(t *testing.T, mode Rotation, now func() time.Time) rotator {
+	r, err := newRotator(mode, rand.New(rand.NewSource(1)), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func testContext(cookies ...*http.Cookie) (echo.Context, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest(http.MethodGet, "/about", nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	return echo.New().NewContext(req, rec), rec
+}
+
+func TestShuffleRounds(t *testing.T) {
+	photos := testPhotos(1, 1, 1, 1, 1)
+	r := testRotator(t, RotationShuffle, nil)
+
+	last := ""
+	for round := 0; round < 20; round++ {
+		seen := map[string]bool{}
+		for range photos {
+			c, _ := testContext()
+			slug := r.Next(c, photos).Slug
+			if seen[slug] {
+				t.Fatalf("round %v showed %v twice", round, slug)
+			}
+			if slug == last {
+				t.Fatalf("round %v started with %v, which ended the round before", round, slug)
+			}
+			seen[slug] = true
+			last = slug
+		}
+	}
+}
+
+func TestShuffleKeepsRoundAcrossReload(t *testing.T) {
+	photos := testPhotos(1, 1, 1, 1)
+	r := testRotator(t, RotationShuffle, nil)
+
+	seen := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		c, _ := testContext()
+		seen[r.Next(c, photos).Slug] = true
+	}
+
+	// A reload removes a photo that wasn't shown yet.
+	var reloaded []ImgInfo
+	removed := ""
+	for _, photo := range photos {
+		if removed == "" && !seen[photo.Slug] {
+			removed = photo.Slug
+			continue
+		}
+		reloaded = append(reloaded, photo)
+	}
+
+	c, _ := testContext()
+	slug := r.Next(c, reloaded).Slug
+	if seen[slug] || slug == removed {
+		t.Errorf("after the reload got %v, want the photo left in the round", slug)
+	}
+}
+
+func TestVisitorNeverRepeats(t *testing.T) {
+	photos := testPhotos(1, 1, 1)
+	r := testRotator(t, RotationVisitor, nil)
+
+	for i := 0; i < 100; i++ {
+		last := photos[i%len(photos)].Slug
+		c, rec := testContext(&http.Cookie{Name: photoCookie, Value: last})
+		slug := r.Next(c, photos).Slug
+		if slug == last {
+			t.Fatalf("showed %v again", last)
+		}
+
+		cookies := rec.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Value != slug {
+			t.Fatalf("cookie %v, want %v", cookies, slug)
+		}
+	}
+}
+
+func TestWeighted(t *testing.T) {
+	photos := testPhotos(0, 1, 3)
+	r := testRotator(t, RotationWeighted, nil)
+
+	counts := map[string]int{}
+	for i := 0; i < 4000; i++ {
+		c, _ := testContext()
+		counts[r.Next(c, photos).Slug]++
+	}
+
+	if counts["photo-0"] != 0 {
+		t.Errorf("photo with weight 0 picked %v times", counts["photo-0"])
+	}
+	ratio := float64(counts["photo-2"]) / float64(counts["photo-1"])
+	if ratio < 2.5 || ratio > 3.5 {
+		t.Errorf("weight 3 picked %.2f times as often as weight 1, want about 3", ratio)
+	}
+}
+
+func TestDaily(t *testing.T) {
+	photos := testPhotos(1, 1, 1, 1)
+	now := testNow
+	r := testRotator(t, RotationDaily, func() time.Time { return now })
+
+	last := ""
+	seen := map[string]bool{}
+	for day := 0; day < 400; day++ {
+		now = testNow.AddDate(0, 0, day)
+		c, _ := testContext()
+		slug := r.Next(c, photos).Slug
+
+		for _, hour := range []int{0, 23} {
+			now = time.Date(now.Year(), now.Month(), now.Day(), hour, 59, 0, 0, time.UTC)
+			c, _ := testContext()
+			if got := r.Next(c, photos).Slug; got != slug {
+				t.Fatalf("day %v showed %v at %v:59, %v earlier", day, got, hour, slug)
+			}
+		}
+
+		if slug == last {
+			t.Fatalf("day %v showed %v again", day, slug)
+		}
+		last = slug
+		seen[slug] = true
+	}
+
+	if len(seen) != len(photos) {
+		t.Errorf("showed %v of %v photos in 400 days", len(seen), len(photos))
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/labstack/echo"
+)
+
+type (
+	// Meta is what the layout puts in a page's head for search engines
+	// and link previews. Every view's data has one.
+	Meta struct {
+		SiteName    string
+		Title       string
+		Description string
+		// URL is the canonical address of the page. Error pages have none.
+		URL      string
+		Image    string
+		ImageAlt string
+		// Type is the Open Graph type: website, article or profile.
+		Type   string
+		Person *Person
+	}
+
+	// personFrontMatter describes who the site is about. It is read from
+	// the home page's front matter.
+	personFrontMatter struct {
+		JobTitle string `yaml:"job_title"`
+		WorksFor string `yaml:"works_for"`
+		Location string `yaml:"location"`
+	}
+
+	// Person is the schema.org JSON-LD block every page carries.
+	Person struct {
+		Context      string  `json:"@context"`
+		Type         string  `json:"@type"`
+		Name         string  `json:"name"`
+		URL          string  `json:"url"`
+		JobTitle     string  `json:"jobTitle,omitempty"`
+		WorksFor     *ldName `json:"worksFor,omitempty"`
+		HomeLocation *ldName `json:"homeLocation,omitempty"`
+		Image        string  `json:"image,omitempty"`
+		// SameAs are the person's profiles elsewhere, taken from the
+		// rel="me" links on the links page.
+		SameAs []string `json:"sameAs,omitempty"`
+	}
+
+	ldName struct {
+		Type string `json:"@type"`
+		Name string `json:"name"`
+	}
+)
+
+// linksPage is the page whose rel="me" links are the person's profiles.
+const linksPage = "/links"
+
+// maxDescription is about as much of a description as search results show.
+const maxDescription = 160
+
+var (
+	anchors = regexp.MustCompile(`<a\s[^>]*>`)
+	hrefs   = regexp.MustCompile(`\shref="(https?://[^"]+)"`)
+	// relMe marks a link as going to another profile of the page's
+	// owner, the way IndieWeb sites do.
+	relMe = regexp.MustCompile(`\srel="(?:[^"]*\s)?me(?:\s[^"]*)?"`)
+)
+
+// setPerson builds the JSON-LD person from the home page and the links
+// page. The home page's image, or else the first photo, stands for the
+// person. It runs after the pages and photos are loaded.
+func setPerson(s *site, cfg Config) {
+	s.person = &Person{
+		Context: "https://schema.org",
+		Type:    "Person",
+		Name:    cfg.Author,
+		URL:     s.baseURL + "/",
+	}
+	home := s.pages[cfg.Home]
+	if home.Image != "" {
+		s.person.Image = s.absURL(home.Image)
+	} else if len(s.images) > 0 {
+		s.person.Image = s.baseURL + s.images[0].URL
+	}
+
+	if fm := home.Person; fm != nil {
+		s.person.JobTitle = fm.JobTitle
+		if fm.WorksFor != "" {
+			s.person.WorksFor = &ldName{Type: "Organization", Name: fm.WorksFor}
+		}
+		if fm.Location != "" {
+			s.person.HomeLocation = &ldName{Type: "Place", Name: fm.Location}
+		}
+	}
+
+	for _, item := range s.pages[linksPage].Content {
+		for _, a := range anchors.FindAllString(string(item.Text), -1) {
+			if m := hrefs.FindStringSubmatch(a); m != nil && relMe.MatchString(a) {
+				s.person.SameAs = append(s.person.SameAs, m[1])
+			}
+		}
+	}
+}
+
+// meta fills in what a page doesn't say about itself: the canonical URL is
+// the one requested and the social image is the person's.
+func (s *site) meta(c echo.Context, title, description string) Meta {
+	m := Meta{
+		SiteName:    s.person.Name,
+		Title:       title,
+		Description: truncate(description, maxDescription),
+		URL:         s.baseURL + c.Request().URL.Path,
+		Image:       s.person.Image,
+		ImageAlt:    s.person.Name,
+		Type:        "website",
+		Person:      s.person,
+	}
+	return m
+}
+
+// withPhoto makes photo the page's social image.
+func (m Meta) withPhoto(base string, photo ImgInfo) Meta {
+	m.Image = base + photo.URL
+	m.ImageAlt = photo.Alt
+	return m
+}
+
+// pageMeta is the meta of a content page, from its front matter where it
+// has any.
+func (s *site) pageMeta(c echo.Context, route string, page PageContent) Meta {
+	title := page.Title
+	if title == "" {
+		title = page.Subhead
+	}
+
+	description := page.Description
+	if description == "" && page.ShowSubcontent {
+		description = plainText(page.Subcontent)
+	}
+	if description == "" && len(page.Content) > 0 {
+		description = plainText(page.Content[0].Text)
+	}
+
+	m := s.meta(c, title, description)
+	m.URL = s.absURL(route)
+	if page.Canonical != "" {
+		m.URL = s.absURL(page.Canonical)
+	}
+	if page.Image != "" {
+		m.Image = s.absURL(page.Image)
+		m.ImageAlt = s.imageAlt(page, title)
+	}
+	if page.Person != nil {
+		m.Type = "profile"
+	}
+	return m
+}
+
+// imageAlt describes the page's image: with the front matter's image_alt,
+// or the alt text of the photo it is, or else fallback.
+func (s *site) imageAlt(page PageContent, fallback string) string {
+	if page.ImageAlt != "" {
+		return page.ImageAlt
+	}
+	for _, photo := range s.images {
+		if photo.URL == escapeURL(page.Image) && photo.Alt != "" {
+			return photo.Alt
+		}
+	}
+	return fallback
+}
+
+// absURL makes a route absolute. URLs that already are are left alone.
+func (s *site) absURL(route string) string {
+	if strings.HasPrefix(route, "/") {
+		return s.baseURL + route
+	}
+	return route
+}
+
+// truncate cuts text at a word so it is at most max bytes, marking the cut.
+// A word longer than that is cut between two runes.
+func truncate(text string, max int) string {
+	if len(text) <= max {
+		return text
+	}
+	cut := max
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	if i := strings.LastIndex(text[:cut], " "); i > 0 {
+		return text[:i] + "…"
+	}
+	return text[:cut] + "…"
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateKeepsRunes(t *testing.T) {
+	for _, text := range []string{
+		strings.Repeat("é", 100),
+		"a " + strings.Repeat("日本", 50),
+		strings.Repeat("x", 79) + "é and more",
+	} {
+		for max := 1; max < len(text); max++ {
+			got := truncate(text, max)
+			if !utf8.ValidString(got) {
+				t.Fatalf("truncate(%q, %v) = %q is not valid UTF-8", text, max, got)
+			}
+			if len(strings.TrimSuffix(got, "…")) > max {
+				t.Fatalf("truncate(%q, %v) = %q is longer than %v bytes", text, max, got, max)
+			}
+		}
+	}
+}
+
+func TestPageImageAlt(t *testing.T) {
+	s := &site{images: []ImgInfo{{URL: "/assets/img/lake%20superior.jpg", Alt: "a rocky shore"}}}
+
+	for _, test := range []struct {
+		page PageContent
+		want string
+	}{
+		{PageContent{Image: "/assets/img/lake superior.jpg", ImageAlt: "the lake"}, "the lake"},
+		{PageContent{Image: "/assets/img/lake superior.jpg"}, "a rocky shore"},
+		{PageContent{Image: "/assets/other.png"}, "About"},
+	} {
+		if got := s.imageAlt(test.page, "About"); got != test.want {
+			t.Errorf("alt of %v is %q, want %q", test.page.Image, got, test.want)
+		}
+	}
+}
+
+func TestSameAsTakesRelMeLinks(t *testing.T) {
+	s := &site{pages: map[string]PageContent{linksPage: {Content: []Item{
+		{Text: `<a href="/resume">resume</a>`},
+		{Text: `<a rel="me" href="https://github.com/someone">github</a>`},
+		{Text: `<a href="https://mastodon.example/@someone" rel="nofollow me">mastodon</a>`},
+		{Text: `<a href="https://github.com/someone/website">the code</a>`},
+		{Text: `<a rel="meta" href="https://example.com/">not me</a>`},
+	}}}}
+	setPerson(s, defaultConfig())
+
+	want := []string{"https://github.com/someone", "https://mastodon.example/@someone"}
+	if !reflect.DeepEqual(s.person.SameAs, want) {
+		t.Errorf("sameAs is %v, want %v", s.person.SameAs, want)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// Exit codes of the process.
+const (
+	exitOK = 0
+	// exitServeError means the listener failed, e.g. the port was taken.
+	exitServeError = 1
+	// exitShutdownError means requests were still running when the drain
+	// timeout ran out, or a shutdown hook failed.
+	exitShutdownError = 2
+	// exitConfigError means the config could not be loaded or is invalid.
+	exitConfigError = 3
+	// exitAssetError means the site could not be loaded from disk.
+	exitAssetError = 4
+	// exitBuildError means build could not write the static copy.
+	exitBuildError = 5
+)
+
+type shutdownHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+var shutdownHooks []shutdownHook
+
+// onShutdown registers fn to run, in registration order, once the server
+// has stopped accepting connections and drained the ones it had.
+func onShutdown(name string, fn func(ctx context.Context) error) {
+	shutdownHooks = append(shutdownHooks, shutdownHook{name: name, fn: fn})
+}
+
+// serve runs each of listeners until SIGINT or SIGTERM, or until one of
+// them fails. It then stops accepting connections, waits up to timeout for
+// in-flight requests, runs the shutdown hooks and returns the code the
+// process should exit with.
+func serve(e *echo.Echo, timeout time.Duration, listeners ...func() error) int {
+	serveErr := make(chan error, len(listeners))
+	for _, listen := range listeners {
+		go func(listen func() error) {
+			serveErr <- listen()
+		}(listen)
+	}
+
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+
+	code := exitOK
+	select {
+	case sig := <-quit:
+		e.Logger.Printf("received %v, draining connections for up to %v", sig, timeout)
+	case err := <-serveErr:
+		if err != http.ErrServerClosed {
+			e.Logger.Error(err)
+			code = exitServeError
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := e.Shutdown(ctx); err != nil {
+		e.Logger.Errorf("draining connections: %v", err)
+		if code == exitOK {
+			code = exitShutdownError
+		}
+	}
+
+	// The hooks get their own deadline so a slow drain doesn't leave them
+	// without time to save anything.
+	hookCtx, hookCancel := context.WithTimeout(context.Background(), timeout)
+	defer hookCancel()
+	for _, hook := range shutdownHooks {
+		if err := hook.fn(hookCtx); err != nil {
+			e.Logger.Errorf("shutdown hook %v: %v", hook.name, err)
+			if code == exitOK {
+				code = exitShutdownError
+			}
+		}
+	}
+
+	e.Logger.Printf("shut down with exit code %v", code)
+	return code
+}
+
+// syncLogs flushes anything the OS is still holding for stdout, where the
+// request log and echo's logger write.
+func syncLogs(ctx context.Context) error {
+	if err := os.Stdout.Sync(); err != nil && !isUnsyncable(err) {
+		return fmt.Errorf("syncing stdout: %v", err)
+	}
+	return nil
+}
+
+// isUnsyncable reports whether err only means stdout is a pipe or terminal,
+// which have nothing to sync.
+func isUnsyncable(err error) bool {
+	pathErr, ok := err.(*os.PathError)
+	return ok && (pathErr.Err == syscall.EINVAL || pathErr.Err == syscall.ENOTSUP)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"html/template"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+type (
+	// site is everything the server reads from disk. A reload builds a new
+	// site from scratch and swaps it in whole, so a request always sees one
+	// consistent version and in-flight requests keep the one they started with.
+	site struct {
+		template *template.Template
+		views    map[string]*template.Template
+		pages    map[string]PageContent
+		posts    []Post
+		images   []ImgInfo
+		icons    []blob
+		blobs    map[string]blob
+		// fingerprints maps a route in blobs to its fingerprinted alias.
+		fingerprints map[string]string
+		cacheControl map[string]string
+		// mimeOverrides are content types by extension from the config.
+		mimeOverrides map[string]string
+		rotator       rotator
+		// baseURL is Config.BaseURL without a trailing slash.
+		baseURL string
+		person  *Person
+		report  LoadReport
+	}
+
+	blob struct {
+		data         []byte
+		contentType  string
+		hash         string
+		modTime      time.Time
+		cacheControl string
+		// variants holds data compressed with each encoding that made it
+		// smaller.
+		variants map[string][]byte
+	}
+
+	// pageRoute is a rendered page, with when it last changed and the
+	// photos on it, for the sitemap.
+	pageRoute struct {
+		route   string
+		modTime time.Time
+		images  []ImgInfo
+	}
+)
+
+// views are pages that reuse the page layout but fill its "main" block with
+// a template of their own. Their files sit next to the layout.
+var views = map[string]string{
+	"stats":  "stats.html",
+	"photos": "photos.html",
+	"photo":  "photo.html",
+	"error":  "error.html",
+	"posts":  "posts.html",
+	"post":   "post.html",
+}
+
+// funcs are the functions available to templates. They are bound to s so
+// templates always link to the assets of the site they were loaded with.
+func (s *site) funcs() template.FuncMap {
+	return template.FuncMap{
+		"top":   top,
+		"asset": s.assetURL,
+	}
+}
+
+// writeView renders the named view with data and sends it.
+func (s *site) writeView(c echo.Context, status int, name string, data interface{}) error {
+	var buf bytes.Buffer
+	if err := s.views[name].Execute(&buf, data); err != nil {
+		return err
+	}
+	return writeHTML(c, status, buf.Bytes())
+}
+
+var current atomic.Value
+
+func currentSite() *site {
+	return current.Load().(*site)
+}
+
+// photo picks the photo to show with the page for c.
+func (s *site) photo(c echo.Context) ImgInfo {
+	return s.rotator.Next(c, s.images)
+}
+
+// pageRoutes lists every page the site renders, sorted by route: the
+// content pages, the posts with their index, tag and year pages, and the
+// photos. The sitemap and the static build both go by it.
+func (s *site) pageRoutes(postsPerPage int) []pageRoute {
+	var routes []pageRoute
+	for route, page := range s.pages {
+		routes = append(routes, pageRoute{route: route, modTime: page.ModTime})
+	}
+
+	newest := func(posts []Post) time.Time {
+		var t time.Time
+		for _, post := range posts {
+			if post.Updated.After(t) {
+				t = post.Updated
+			}
+		}
+		return t
+	}
+	for page := 1; page == 1 || (page-1)*postsPerPage < len(s.posts); page++ {
+		start, end := (page-1)*postsPerPage, page*postsPerPage
+		if end > len(s.posts) {
+			end = len(s.posts)
+		}
+		route := "/posts"
+		if page > 1 {
+			route = fmt.Sprintf("/posts?page=%v", page)
+		}
+		routes = append(routes, pageRoute{route: route, modTime: newest(s.posts[start:end])})
+	}
+
+	tagged := map[string][]Post{}
+	written := map[int][]Post{}
+	for _, post := range s.posts {
+		routes = append(routes, pageRoute{route: "/posts/" + post.Slug, modTime: post.Updated})
+		for _, tag := range post.Tags {
+			tagged[tag] = append(tagged[tag], post)
+		}
+		written[post.Date.Year()] = append(written[post.Date.Year()], post)
+	}
+	for tag, posts := range tagged {
+		routes = append(routes, pageRoute{route: "/tags/" + tag, modTime: newest(posts)})
+	}
+	for year, posts := range written {
+		routes = append(routes, pageRoute{route: fmt.Sprintf("/archive/%v", year), modTime: newest(posts)})
+	}
+
+	routes = append(routes, pageRoute{route: "/photos", images: s.images})
+	for _, img := range s.images {
+		routes = append(routes, pageRoute{route: "/photos/" + img.Slug, images: []ImgInfo{img}})
+	}
+
+	sort.Slice(routes, func(i, j int) bool { return routes[i].route < routes[j].route })
+	return routes
+}
+
+// loadSite reads everything the site needs from disk. It keeps going past
+// problems and returns them all in the report; a site is only returned
+// when nothing fatal went wrong.
+func loadSite(cfg Config) (*site, LoadReport) {
+	s := &site{
+		views:         map[string]*template.Template{},
+		blobs:         map[string]blob{},
+		fingerprints:  map[string]string{},
+		cacheControl:  cfg.CacheControl,
+		mimeOverrides: cfg.MIMETypes,
+		baseURL:       strings.TrimSuffix(cfg.BaseURL, "/"),
+	}
+	report := &s.report
+
+	loadTemplates(s, cfg.Template, report)
+	s.pages = loadPages(cfg.ContentDir, cfg.Home, report)
+	s.posts = loadPosts(cfg.PostsDir, report)
+
+	for route, file := range cfg.Files {
+		if err := serveFileWithCache(s, file, route, classFile); err != nil {
+			report.add("file", file, err, false)
+		}
+	}
+	setIcons(s, cfg.Favicons, report)
+	setImg(s, cfg.ImageDir, cfg.ImageRoute, cfg.Images, report)
+	setPerson(s, cfg)
+	setFeeds(s, cfg, report)
+	setSitemap(s, cfg, report)
+
+	var err error
+	s.rotator, err = newRotator(cfg.Images.Rotation, rand.New(rand.NewSource(time.Now().UnixNano())), time.Now)
+	if err != nil {
+		report.add("config", "images.rotation", err, true)
+	}
+
+	if report.Fatal() {
+		return nil, *report
+	}
+	return s, *report
+}
+
+// loadTemplates parses the layout in file, then every view next to it on
+// top of a copy of the layout.
+func loadTemplates(s *site, file string, report *LoadReport) {
+	var err error
+	s.template, err = template.New(filepath.Base(file)).Funcs(s.funcs()).ParseFiles(file)
+	if err != nil {
+		report.add("template", file, err, true)
+		return
+	}
+
+	for name, view := range views {
+		path := filepath.Join(filepath.Dir(file), view)
+		layout, err := s.template.Clone()
+		if err == nil {
+			s.views[name], err = layout.ParseFiles(path)
+		}
+		if err != nil {
+			report.add("view", path, err, true)
+		}
+	}
+}
+
+// watchSite polls the watched directories and reloads the site whenever
+// anything in them changes. A reload with problems leaves the last good site
+// in place, unless degraded mode is allowed and none of them are fatal.
+func watchSite(cfg Config, logf func(format string, args ...interface{})) {
+	dirs := cfg.watchDirs()
+	last := fingerprint(dirs)
+	for range time.Tick(cfg.ReloadInterval) {
+		next := fingerprint(dirs)
+		if next == last {
+			continue
+		}
+		last = next
+
+		s, report := loadSite(cfg)
+		if !report.usable(cfg.AllowDegraded) {
+			logf("reload failed, keeping previous version: %v", report)
+			continue
+		}
+		if !report.OK() {
+			logf("reloaded in degraded mode: %v", report)
+		}
+		// Keep the rotator, so a shuffle round isn't dealt over again on
+		// every edit.
+		s.rotator = currentSite().rotator
+		current.Store(s)
+		logf("reloaded site")
+	}
+}
+
+// fingerprint hashes the name, size and modification time of every file
+// under dirs.
+func fingerprint(dirs []string) uint64 {
+	h := fnv.New64a()
+	for _, dir := range dirs {
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				fmt.Fprintf(h, "%v:error;", path)
+				return nil
+			}
+			fmt.Fprintf(h, "%v:%v:%v;", path, info.Size(), info.ModTime().UnixNano())
+			return nil
+		})
+	}
+	return h.Sum64()
+}
+
+// fileFingerprints hashes the size and modification time of each file
+// under dirs, by path.
+func fileFingerprints(dirs []string) map[string]uint64 {
+	sums := map[string]uint64{}
+	for _, dir := range dirs {
+		filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err == nil && info.Mode().IsRegular() {
+				h := fnv.New64a()
+				fmt.Fprintf(h, "%v:%v", info.Size(), info.ModTime().UnixNano())
+				sums[path] = h.Sum64()
+			}
+			return nil
+		})
+	}
+	return sums
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type (
+	// RobotsConfig is what robots.txt asks crawlers to stay out of.
+	RobotsConfig struct {
+		// Disallow lists route prefixes crawlers shouldn't fetch.
+		Disallow []string `yaml:"disallow"`
+	}
+
+	sitemapImage struct {
+		Loc string `xml:"image:loc"`
+	}
+
+	sitemapURL struct {
+		Loc     string         `xml:"loc"`
+		LastMod string         `xml:"lastmod,omitempty"`
+		Images  []sitemapImage `xml:"image:image"`
+	}
+)
+
+// setSitemap lists every page the site renders in sitemap.xml, and points
+// crawlers at it from robots.txt. Both are served like files.
+func setSitemap(s *site, cfg Config, report *LoadReport) {
+	base := s.baseURL
+	var urls []sitemapURL
+	var newest time.Time
+	add := func(route string, modTime time.Time, images ...ImgInfo) {
+		u := sitemapURL{Loc: base + route}
+		if !modTime.IsZero() {
+			u.LastMod = modTime.UTC().Format(time.RFC3339)
+			if modTime.After(newest) {
+				newest = modTime
+			}
+		}
+		for _, img := range images {
+			u.Images = append(u.Images, sitemapImage{Loc: base + img.URL})
+		}
+		urls = append(urls, u)
+	}
+
+	for _, page := range s.pageRoutes(cfg.PostsPerPage) {
+		add(page.route, page.modTime, page.images...)
+	}
+
+	data, err := marshalXML(struct {
+		XMLName xml.Name     `xml:"http://www.sitemaps.org/schemas/sitemap/0.9 urlset"`
+		Image   string       `xml:"xmlns:image,attr"`
+		URLs    []sitemapURL `xml:"url"`
+	}{
+		Image: "http://www.google.com/schemas/sitemap-image/1.1",
+		URLs:  urls,
+	})
+	if err != nil {
+		report.add("sitemap", "/sitemap.xml", err, false)
+		return
+	}
+	if newest.IsZero() {
+		newest = time.Now()
+	}
+	s.blobs["/sitemap.xml"] = newBlob(data, "application/xml; charset=utf-8", newest, s.cacheControl[classFile])
+
+	var robots strings.Builder
+	fmt.Fprintf(&robots, "User-agent: *\n")
+	for _, route := range cfg.Robots.Disallow {
+		fmt.Fprintf(&robots, "Disallow: %v\n", route)
+	}
+	if len(cfg.Robots.Disallow) == 0 {
+		fmt.Fprintf(&robots, "Disallow:\n")
+	}
+	fmt.Fprintf(&robots, "\nSitemap: %v/sitemap.xml\n", base)
+	s.blobs["/robots.txt"] = newBlob([]byte(robots.String()), "text/plain; charset=utf-8", newest, s.cacheControl[classFile])
+}
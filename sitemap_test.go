@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSitemapListsEveryPage(t *testing.T) {
+	day := func(y, m int) time.Time { return time.Date(y, time.Month(m), 1, 0, 0, 0, 0, time.UTC) }
+	s := &site{
+		pages: map[string]PageContent{"/about": {}},
+		posts: []Post{
+			{Slug: "c", Date: day(2020, 3), Updated: day(2020, 3), Tags: []string{"go"}},
+			{Slug: "b", Date: day(2020, 2), Updated: day(2020, 2)},
+			{Slug: "a", Date: day(2019, 1), Updated: day(2019, 1), Tags: []string{"go", "meta"}},
+		},
+		blobs:   map[string]blob{},
+		baseURL: "https://example.com",
+	}
+	cfg := defaultConfig()
+	cfg.PostsPerPage = 2
+	setSitemap(s, cfg, &LoadReport{})
+
+	sitemap := string(s.blobs["/sitemap.xml"].data)
+	for _, page := range s.pageRoutes(cfg.PostsPerPage) {
+		if !strings.Contains(sitemap, "<loc>https://example.com"+page.route+"</loc>") {
+			t.Errorf("sitemap is missing %v", page.route)
+		}
+	}
+	for _, route := range []string{"/posts?page=2", "/tags/go", "/tags/meta", "/archive/2019", "/archive/2020"} {
+		if !strings.Contains(sitemap, "<loc>https://example.com"+route+"</loc>") {
+			t.Errorf("sitemap is missing %v", route)
+		}
+	}
+	if strings.Contains(sitemap, "/posts?page=3") {
+		t.Error("sitemap lists a posts page past the last post")
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+type (
+	Stats struct {
+		Uptime    time.Time `json:"uptime_since"`
+		SinceBoot Counters  `json:"since_boot"`
+		AllTime   Counters  `json:"all_time"`
+		analytics *Analytics
+		ips       *ipAnonymizer
+		proxies   proxies
+		maxIPs    int
+		store     StatsStore
+		mutex     sync.RWMutex
+	}
+
+	// Counters are the request totals over some period. AllTime is what
+	// gets persisted by a StatsStore.
+	Counters struct {
+		Since        time.Time      `json:"since"`
+		RequestCount uint64         `json:"request_count"`
+		Statuses     map[string]int `json:"statuses"`
+		IPAddresses  map[string]int `json:"requests_by_ip_address"`
+	}
+
+	// StatsStore persists the all time counters between runs. Ping
+	// reports whether the store can currently be written to.
+	StatsStore interface {
+		Load() (Counters, error)
+		Save(Counters) error
+		Ping() error
+	}
+
+	// jsonFileStore keeps the counters in a single JSON file.
+	jsonFileStore struct {
+		path string
+	}
+)
+
+func newCounters(since time.Time) Counters {
+	return Counters{
+		Since:       since,
+		Statuses:    map[string]int{},
+		IPAddresses: map[string]int{},
+	}
+}
+
+// clone copies the maps too, so the copy can be used without holding the
+// Stats mutex.
+func (c Counters) clone() Counters {
+	out := c
+	out.Statuses = make(map[string]int, len(c.Statuses))
+	for k, v := range c.Statuses {
+		out.Statuses[k] = v
+	}
+	out.IPAddresses = make(map[string]int, len(c.IPAddresses))
+	for k, v := range c.IPAddresses {
+		out.IPAddresses[k] = v
+	}
+	return out
+}
+
+// NewStats reloads the all time counters from store. A store with nothing
+// in it yet starts the all time counters now. Addresses are recorded
+// according to ipMode, keeping only the maxIPs busiest ones.
+func NewStats(store StatsStore, ipMode IPMode, maxIPs int, trustedProxies []string) (*Stats, error) {
+	now := time.Now().UTC()
+
+	ips, err := newIPAnonymizer(ipMode)
+	if err != nil {
+		return nil, err
+	}
+	if maxIPs < 1 {
+		return nil, fmt.Errorf("max ips must be at least 1, got %v", maxIPs)
+	}
+	proxies, err := parseProxies(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
+	allTime, err := store.Load()
+	if err != nil {
+		return nil, err
+	}
+	if allTime.Since.IsZero() {
+		allTime.Since = now
+	}
+	if allTime.Statuses == nil {
+		allTime.Statuses = map[string]int{}
+	}
+	allTime.IPAddresses = rekeyIPs(allTime.IPAddresses, ips, maxIPs, now)
+
+	return &Stats{
+		Uptime:    now,
+		SinceBoot: newCounters(now),
+		AllTime:   allTime,
+		analytics: NewAnalytics(),
+		ips:       ips,
+		proxies:   proxies,
+		maxIPs:    maxIPs,
+		store:     store,
+	}, nil
+}
+
+// Process is the middleware function.
+func (s *Stats) Process(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		timeIn := time.Now().UTC()
+		if err := next(c); err != nil {
+			c.Error(err)
+		}
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		currentTime := time.Now().UTC()
+		status := strconv.Itoa(c.Response().Status)
+		ip, recordIP := s.ips.Key(s.proxies.clientIP(c.Request()), currentTime)
+		for _, counters := range []*Counters{&s.SinceBoot, &s.AllTime} {
+			counters.RequestCount++
+			counters.Statuses[status]++
+			if recordIP {
+				incrCapped(counters.IPAddresses, ip, s.maxIPs)
+			}
+		}
+
+		s.analytics.Record(c, timeIn, currentTime)
+		if !recordIP {
+			ip = "-"
+		}
+		log(c, ip, timeIn, currentTime)
+		return nil
+	}
+}
+
+// Flush writes the all time counters to the store.
+func (s *Stats) Flush() error {
+	s.mutex.RLock()
+	allTime := s.AllTime.clone()
+	s.mutex.RUnlock()
+
+	return s.store.Save(allTime)
+}
+
+// FlushEvery flushes the counters on a fixed interval until the process
+// exits.
+func (s *Stats) FlushEvery(interval time.Duration, logf func(format string, args ...interface{})) {
+	for range time.Tick(interval) {
+		if err := s.Flush(); err != nil {
+			logf("flushing stats: %v", err)
+		}
+	}
+}
+
+// log prints one line per request. ip is the visitor's address as
+// ip_mode records it, never the raw one unless that's the mode.
+func log(c echo.Context, ip string, timeIn time.Time, currentTime time.Time) {
+	fmt.Printf("%v | %v | %v | %v | %v | %v \n",
+		timeIn.Format(time.RFC3339),
+		ip,
+		c.Response().Status,
+		c.Request().Method,
+		c.Request().URL.Path,
+		currentTime.Sub(timeIn).String(),
+	)
+}
+
+func newJSONFileStore(path string) *jsonFileStore {
+	return &jsonFileStore{path: path}
+}
+
+func (j *jsonFileStore) Load() (Counters, error) {
+	var counters Counters
+
+	data, err := ioutil.ReadFile(j.path)
+	if os.IsNotExist(err) {
+		return counters, nil
+	}
+	if err != nil {
+		return counters, err
+	}
+
+	if err := json.Unmarshal(data, &counters); err != nil {
+		return counters, fmt.Errorf("%v: %v", j.path, err)
+	}
+
+	return counters, nil
+}
+
+// Save writes to a temporary file and renames it over the old one, so a
+// crash mid-write never leaves a truncated file behind.
+func (j *jsonFileStore) Save(counters Counters) error {
+	data, err := json.MarshalIndent(counters, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(j.path), filepath.Base(j.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), j.path)
+}
+
+// Ping checks that the directory holding the file still exists, which is
+// what Save needs to succeed.
+func (j *jsonFileStore) Ping() error {
+	info, err := os.Stat(filepath.Dir(j.path))
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%v is not a directory", filepath.Dir(j.path))
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	"github.com/labstack/echo"
+	"github.com/labstack/echo/middleware"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// TLSConfig turns on serving HTTPS directly, with certificates from an
+// ACME CA such as Let's Encrypt, instead of sitting behind a proxy.
+type TLSConfig struct {
+	ACME bool `yaml:"acme"`
+	// Hosts are the only names certificates will be requested for.
+	Hosts []string `yaml:"hosts"`
+	Email string   `yaml:"email"`
+	// CacheDir keeps certificates across restarts, so they aren't
+	// requested again on every deploy.
+	CacheDir string `yaml:"cache_dir"`
+	// DirectoryURL defaults to Let's Encrypt. Point it and DirectoryCA at
+	// a local test CA to try the setup without hitting rate limits.
+	DirectoryURL string `yaml:"directory_url"`
+	DirectoryCA  string `yaml:"directory_ca"`
+	// HTTPAddr answers HTTP-01 challenges and redirects everything else
+	// to HTTPSAddr.
+	HTTPAddr  string `yaml:"http_addr"`
+	HTTPSAddr string `yaml:"https_addr"`
+
+	HSTSMaxAge            int  `yaml:"hsts_max_age"`
+	HSTSExcludeSubdomains bool `yaml:"hsts_exclude_subdomains"`
+}
+
+// setACME configures e to get its certificates through ACME and returns the
+// functions serve should run. The plain HTTP listener runs on e.Server, so
+// e.Shutdown drains it along with the HTTPS one.
+func setACME(e *echo.Echo, cfg TLSConfig) ([]func() error, error) {
+	client := &acme.Client{DirectoryURL: cfg.DirectoryURL}
+	if cfg.DirectoryCA != "" {
+		pem, err := ioutil.ReadFile(cfg.DirectoryCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%v: no certificates found", cfg.DirectoryCA)
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		}
+	}
+
+	e.AutoTLSManager = autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.Hosts...),
+		Cache:      autocert.DirCache(cfg.CacheDir),
+		Email:      cfg.Email,
+		Client:     client,
+	}
+
+	e.Server.Addr = cfg.HTTPAddr
+	e.Server.Handler = e.AutoTLSManager.HTTPHandler(httpsRedirect(cfg.HTTPSAddr))
+
+	return []func() error{
+		e.Server.ListenAndServe,
+		func() error { return e.StartAutoTLS(cfg.HTTPSAddr) },
+	}, nil
+}
+
+// httpsRedirect permanently redirects to the same URL over HTTPS, keeping
+// the port when HTTPS isn't on the default one.
+func httpsRedirect(httpsAddr string) http.Handler {
+	_, port, _ := net.SplitHostPort(httpsAddr)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// hsts sends Strict-Transport-Security on HTTPS responses.
+func hsts(cfg TLSConfig) echo.MiddlewareFunc {
+	return middleware.SecureWithConfig(middleware.SecureConfig{
+		HSTSMaxAge:            cfg.HSTSMaxAge,
+		HSTSExcludeSubdomains: cfg.HSTSExcludeSubdomains,
+	})
+}